@@ -1,13 +1,12 @@
 package api
 
 import (
-	"context"
-	"fmt"
 	"log"
 	"os"
 	"time"
 
-	"github.com/go-redis/redis/v8"
+	"github.com/zhitoo/cdn/cache"
+	"github.com/zhitoo/cdn/health"
 	"github.com/zhitoo/cdn/requests"
 	"github.com/zhitoo/cdn/storage"
 
@@ -21,7 +20,6 @@ import (
 )
 
 const maxRedisValueSize = 100 * 1024 // 100KB
-const fileTrackingZSet = "file_cache_tracker"
 
 type ApiError struct {
 	Message string
@@ -31,21 +29,26 @@ type APIServer struct {
 	listenAddr string
 	storage    storage.Storage
 	validator  *requests.Validator
-	rdb        *redis.Client
+	store      cache.CacheStore
+	health     health.Store
 }
 
-func NewAPIServer(listenAddr string, storage storage.Storage, validator *requests.Validator, rdb *redis.Client) *APIServer {
+func NewAPIServer(listenAddr string, storage storage.Storage, validator *requests.Validator, store cache.CacheStore, healthStore health.Store) *APIServer {
 	return &APIServer{
 		listenAddr: listenAddr,
 		storage:    storage,
 		validator:  validator,
-		rdb:        rdb,
+		store:      store,
+		health:     healthStore,
 	}
 }
 
 func (s *APIServer) Run() {
+	// Prefork children do not share memory, so the in-memory store needs a single process
+	_, inMemory := s.store.(*cache.MemoryStore)
 	app := fiber.New(fiber.Config{
-		Prefork: true,
+		Prefork:        !inMemory,
+		RequestMethods: append(fiber.DefaultMethods, "PURGE"),
 	})
 
 	app.Use(func(c *fiber.Ctx) error {
@@ -61,8 +64,19 @@ func (s *APIServer) Run() {
 		AllowOrigins: "*",
 		AllowHeaders: "Origin, Content-Type, Accept",
 	}))
-	app.Use(etag.New())
-	app.Use(compress.New())
+	app.Use(etag.New(etag.Config{
+		// Static content is streamed, which the etag middleware would buffer
+		// in memory. serveStatic answers conditional requests itself.
+		Next: func(c *fiber.Ctx) bool {
+			return c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead
+		},
+	}))
+	app.Use(compress.New(compress.Config{
+		// Compressing a partial response would break its Content-Range
+		Next: func(c *fiber.Ctx) bool {
+			return c.Get("Range") != ""
+		},
+	}))
 	app.Use(limiter.New(limiter.Config{
 		Max:        100,
 		Expiration: 1 * time.Minute,
@@ -75,10 +89,21 @@ func (s *APIServer) Run() {
 
 	// Routes
 	app.Post("/register", s.registerOriginServer)
+	app.Post("/purge", s.purgeCache)
+	app.Post("/purge/tags", s.purgeCacheTags)
+	app.Post("/warmup", s.warmUpCache)
+	app.Add("PURGE", "/*", s.purgeRequest)
+	app.Get("/health/origins", s.originHealthStatus)
 	app.Get("/*", s.serveStatic)
 	log.Fatal(app.Listen(s.listenAddr))
 }
 
+// validAPIKey checks a key sent by a client against the API_KEY environment variable.
+func validAPIKey(apiKey string) bool {
+	expectedAPIKey := os.Getenv("API_KEY")
+	return expectedAPIKey != "" && apiKey == expectedAPIKey
+}
+
 func securityHeaders(c *fiber.Ctx) error {
 	c.Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
 	c.Set("X-Content-Type-Options", "nosniff")
@@ -87,42 +112,11 @@ func securityHeaders(c *fiber.Ctx) error {
 	return c.Next()
 }
 
-func cleanUpCache(rdb *redis.Client) {
-	ctx := context.Background()
-
-	now := time.Now().Unix()
-
-	// Get all file paths with expiration time less than or equal to now
-	expiredFiles, err := rdb.ZRangeByScore(ctx, fileTrackingZSet, &redis.ZRangeBy{
-		Min: "0",
-		Max: fmt.Sprintf("%d", now),
-	}).Result()
-	if err != nil {
-		log.Printf("Error fetching expired files from ZSet: %v", err)
-		return
-	}
-
-	for _, filePath := range expiredFiles {
-		// Delete the file from disk
-		err := os.Remove(filePath)
-		if err != nil && !os.IsNotExist(err) {
-			log.Printf("Error deleting file %s: %v", filePath, err)
-			continue
-		}
-
-		// Remove the file path from the sorted set
-		_, err = rdb.ZRem(ctx, fileTrackingZSet, filePath).Result()
-		if err != nil {
-			log.Printf("Error removing file %s from ZSet: %v", filePath, err)
-		}
-	}
-}
-
 func (s *APIServer) StartCacheCleaner() {
 	ticker := time.NewTicker(60 * time.Minute)
 	go func() {
 		for range ticker.C {
-			cleanUpCache(s.rdb)
+			s.store.CleanUp()
 		}
 	}()
 }
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zhitoo/cdn/config"
+	"github.com/zhitoo/cdn/models"
+)
+
+// parseCacheControl parses a Cache-Control style header value into a map of
+// lower-cased directive names to their (unquoted) values.
+func parseCacheControl(value string) map[string]string {
+	directives := map[string]string{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, val, _ := strings.Cut(part, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		// Surrogate-Control may target a directive at a device, e.g. max-age=60;edge
+		val, _, _ = strings.Cut(val, ";")
+		directives[name] = strings.Trim(strings.TrimSpace(val), `"`)
+	}
+	return directives
+}
+
+// directiveSeconds returns the value of a delta-seconds directive such as max-age.
+func directiveSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	val, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// getCacheExpireTime derives how long an origin response may be cached from its
+// Surrogate-Control, Cache-Control and Expires headers. The returned bool is
+// false when the origin forbids shared caching (no-store, private). A zero TTL
+// means the response is stale right away and must be revalidated before reuse.
+// When the origin says nothing, fallback is used.
+func getCacheExpireTime(header http.Header, fallback time.Duration) (time.Duration, bool) {
+	// Surrogate-Control is aimed at CDNs and takes precedence over Cache-Control
+	surrogate := parseCacheControl(strings.Join(header.Values("Surrogate-Control"), ","))
+	if _, ok := surrogate["no-store"]; ok {
+		return 0, false
+	}
+	if ttl, ok := directiveSeconds(surrogate, "max-age"); ok {
+		return ttl, true
+	}
+
+	cacheControl := parseCacheControl(strings.Join(header.Values("Cache-Control"), ","))
+	if _, ok := cacheControl["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cacheControl["private"]; ok {
+		return 0, false
+	}
+	if _, ok := cacheControl["no-cache"]; ok {
+		// May be stored, but must be revalidated before every use
+		return 0, true
+	}
+
+	// Time the response already spent in upstream caches
+	age, _ := strconv.ParseInt(header.Get("Age"), 10, 64)
+	current := time.Duration(age) * time.Second
+
+	if ttl, ok := directiveSeconds(cacheControl, "s-maxage"); ok {
+		return max(ttl-current, 0), true
+	}
+	if ttl, ok := directiveSeconds(cacheControl, "max-age"); ok {
+		return max(ttl-current, 0), true
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			// Invalid Expires values such as "0" mean already expired
+			return 0, true
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return max(expiresAt.Sub(date), 0), true
+	}
+
+	return fallback, true
+}
+
+// getStaleWindows returns, in seconds, how long an expired response may still be
+// served while it is revalidated in the background and while the origin is
+// failing. RFC 5861 directives sent by the origin override the configured defaults.
+func getStaleWindows(header http.Header) (int64, int64) {
+	cacheControl := parseCacheControl(strings.Join(header.Values("Cache-Control"), ","))
+	_, noCache := cacheControl["no-cache"]
+	_, mustRevalidate := cacheControl["must-revalidate"]
+	_, proxyRevalidate := cacheControl["proxy-revalidate"]
+	if noCache || mustRevalidate || proxyRevalidate {
+		// Stale responses must never be used
+		return 0, 0
+	}
+
+	staleWhileRevalidate := config.Envs.StaleWhileRevalidate
+	if window, ok := directiveSeconds(cacheControl, "stale-while-revalidate"); ok {
+		staleWhileRevalidate = int64(window.Seconds())
+	}
+	staleIfError := config.Envs.StaleIfError
+	if window, ok := directiveSeconds(cacheControl, "stale-if-error"); ok {
+		staleIfError = int64(window.Seconds())
+	}
+	return staleWhileRevalidate, staleIfError
+}
+
+// siteDefaultTTL returns the fallback TTL configured for an origin server.
+func siteDefaultTTL(origin *models.OriginServer) time.Duration {
+	if origin.DefaultCacheTTL > 0 {
+		return time.Duration(origin.DefaultCacheTTL) * time.Second
+	}
+	return time.Duration(config.Envs.DefaultCacheTTL) * time.Second
+}
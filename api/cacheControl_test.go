@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/zhitoo/cdn/config"
+)
+
+func TestGetCacheExpireTime(t *testing.T) {
+	fallback := time.Hour
+	tests := []struct {
+		name      string
+		header    http.Header
+		ttl       time.Duration
+		cacheable bool
+	}{
+		{"no headers", http.Header{}, fallback, true},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute, true},
+		{"s-maxage wins", http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute, true},
+		{"age is subtracted", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"20"}}, 40 * time.Second, true},
+		{"age beyond max-age", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"90"}}, 0, true},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, 0, false},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, 0, false},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, 0, true},
+		{"surrogate-control wins", http.Header{"Surrogate-Control": {"max-age=300"}, "Cache-Control": {"no-store"}}, 5 * time.Minute, true},
+		{"surrogate no-store", http.Header{"Surrogate-Control": {"no-store"}, "Cache-Control": {"max-age=60"}}, 0, false},
+		{"invalid max-age", http.Header{"Cache-Control": {"max-age=soon"}}, fallback, true},
+		{"expires", http.Header{
+			"Date":    {"Mon, 02 Jan 2006 15:04:05 GMT"},
+			"Expires": {"Mon, 02 Jan 2006 15:14:05 GMT"},
+		}, 10 * time.Minute, true},
+		{"invalid expires", http.Header{"Expires": {"0"}}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, cacheable := getCacheExpireTime(tt.header, fallback)
+			if ttl != tt.ttl || cacheable != tt.cacheable {
+				t.Errorf("got (%v, %v), want (%v, %v)", ttl, cacheable, tt.ttl, tt.cacheable)
+			}
+		})
+	}
+}
+
+func TestGetStaleWindows(t *testing.T) {
+	defaultSWR, defaultSIE := config.Envs.StaleWhileRevalidate, config.Envs.StaleIfError
+	tests := []struct {
+		name         string
+		cacheControl string
+		swr, sie     int64
+	}{
+		{"defaults", "max-age=60", defaultSWR, defaultSIE},
+		{"directives", "max-age=60, stale-while-revalidate=30, stale-if-error=600", 30, 600},
+		{"only one directive", "stale-if-error=10", defaultSWR, 10},
+		{"no-cache", "no-cache, stale-if-error=600", 0, 0},
+		{"must-revalidate", "max-age=60, must-revalidate", 0, 0},
+		{"proxy-revalidate", "proxy-revalidate", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			swr, sie := getStaleWindows(http.Header{"Cache-Control": {tt.cacheControl}})
+			if swr != tt.swr || sie != tt.sie {
+				t.Errorf("got (%d, %d), want (%d, %d)", swr, sie, tt.swr, tt.sie)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/zhitoo/cdn/cache"
+)
+
+// cacheFillReader streams an origin body to the client while copying it into a
+// temporary file in the cache directory. Once the body has been read completely
+// the file is atomically renamed into place and onComplete registers it with its
+// size and hex SHA-256, so a partially written file is never visible in the cache.
+type cacheFillReader struct {
+	body       io.Reader
+	closer     io.Closer // the origin response body
+	tmp        *os.File
+	filePath   string
+	size       int64 // expected size, -1 when unknown
+	written    int64
+	hash       hash.Hash
+	onComplete func(filePath string, size int64, contentHash string)
+	// release is called once the body is cached or given up on
+	release     func()
+	releaseOnce sync.Once
+
+	closeOnce sync.Once
+	done      bool
+	err       error
+}
+
+// newCacheFillReader creates the temporary file for cacheKey. body of size bytes
+// (-1 when unknown) is read from and closer is closed together with the reader.
+func newCacheFillReader(cacheKey string, body io.Reader, size int64, closer io.Closer, onComplete func(filePath string, size int64, contentHash string)) (*cacheFillReader, error) {
+	// Ensure the base directory exists
+	if err := os.MkdirAll(cache.BaseDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	// Make room for the file within the disk budget
+	if size > 0 {
+		cache.Reserve(size)
+	}
+
+	tmp, err := os.CreateTemp(cache.BaseDir, cache.SafeFileName(cacheKey)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	return &cacheFillReader{
+		body:       body,
+		closer:     closer,
+		tmp:        tmp,
+		filePath:   cache.FilePath(cacheKey),
+		size:       size,
+		hash:       sha256.New(),
+		onComplete: onComplete,
+	}, nil
+}
+
+func (r *cacheFillReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 && r.tmp != nil {
+		if _, werr := r.tmp.Write(p[:n]); werr != nil {
+			// Keep serving the client, just give up on caching
+			log.Printf("Error writing cache file: %v", werr)
+			r.err = werr
+			r.discard()
+		}
+		r.written += int64(n)
+		r.hash.Write(p[:n])
+	}
+	if err == io.EOF {
+		r.finish()
+	} else if err != nil {
+		r.err = err
+		r.discard()
+	}
+	return n, err
+}
+
+// Close releases the origin body. Reading stopped before the end (for example
+// because the client went away) discards the temporary file.
+func (r *cacheFillReader) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		if !r.done {
+			r.discard()
+		}
+		err = r.closer.Close()
+		r.releaseLock()
+	})
+	return err
+}
+
+// releaseLock calls release once, when the outcome of the fill is known.
+func (r *cacheFillReader) releaseLock() {
+	if r.release != nil {
+		r.releaseOnce.Do(r.release)
+	}
+}
+
+// finish moves the completely written file into place and registers it.
+func (r *cacheFillReader) finish() {
+	if r.done || r.tmp == nil {
+		return
+	}
+	defer r.releaseLock()
+	r.done = true
+	tmpPath := r.tmp.Name()
+	if err := r.tmp.Close(); err != nil {
+		r.err = err
+		os.Remove(tmpPath)
+		return
+	}
+	r.tmp = nil
+	if r.size <= 0 {
+		cache.Reserve(r.written)
+	}
+	if err := os.Rename(tmpPath, r.filePath); err != nil {
+		r.err = err
+		os.Remove(tmpPath)
+		return
+	}
+	r.onComplete(r.filePath, r.written, hex.EncodeToString(r.hash.Sum(nil)))
+}
+
+func (r *cacheFillReader) discard() {
+	defer r.releaseLock()
+	if r.tmp == nil {
+		return
+	}
+	tmpPath := r.tmp.Name()
+	r.tmp.Close()
+	os.Remove(tmpPath)
+	r.tmp = nil
+}
+
+// fill reads the whole body without a client, returning the path of the cached file.
+func (r *cacheFillReader) fill() (string, error) {
+	defer r.Close()
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return "", err
+	}
+	if r.err != nil {
+		return "", r.err
+	}
+	if !r.done {
+		return "", io.ErrUnexpectedEOF
+	}
+	return r.filePath, nil
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zhitoo/cdn/cache"
+)
+
+func TestCacheFillReader(t *testing.T) {
+	body := strings.Repeat("0123456789", 1000)
+	sum := sha256.Sum256([]byte(body))
+	tests := []struct {
+		name   string
+		read   int // bytes the client reads before closing, -1 for all
+		cached bool
+	}{
+		{"complete body", -1, true},
+		{"client went away", 100, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			saved := cache.BaseDir
+			cache.BaseDir = dir
+			defer func() { cache.BaseDir = saved }()
+
+			var completed bool
+			var gotSize int64
+			var gotHash string
+			filler, err := newCacheFillReader("s:/big", strings.NewReader(body), int64(len(body)), io.NopCloser(nil), func(filePath string, size int64, contentHash string) {
+				completed, gotSize, gotHash = true, size, contentHash
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			released := 0
+			filler.release = func() { released++ }
+
+			if tt.read < 0 {
+				if _, err := io.ReadAll(filler); err != nil {
+					t.Fatal(err)
+				}
+				if released != 1 {
+					t.Errorf("released %d times once the body was read, want 1", released)
+				}
+			} else {
+				io.ReadFull(filler, make([]byte, tt.read))
+				if released != 0 {
+					t.Errorf("released while the body is still streaming")
+				}
+			}
+			filler.Close()
+			if released != 1 {
+				t.Errorf("released %d times, want 1", released)
+			}
+
+			if completed != tt.cached {
+				t.Fatalf("completed = %v, want %v", completed, tt.cached)
+			}
+			_, err = os.Stat(cache.FilePath("s:/big"))
+			if tt.cached {
+				if err != nil {
+					t.Errorf("cache file missing: %v", err)
+				}
+				if gotSize != int64(len(body)) || gotHash != hex.EncodeToString(sum[:]) {
+					t.Errorf("registered size %d hash %s", gotSize, gotHash)
+				}
+			} else if !os.IsNotExist(err) {
+				t.Errorf("partial body left in the cache: %v", err)
+			}
+			if tmps, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmps) > 0 {
+				t.Errorf("temporary files left: %v", tmps)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// applyCacheKeyPolicy rebuilds the cache key of a resolved resource from the
+// cache key policy of its site, the raw query string and the request headers,
+// and selects the query parameters the site forwards to the origin. Without a
+// policy the key stays siteIdentifier:path?width=&height=.
+func (res *resource) applyCacheKeyPolicy(rawQuery string) {
+	origin := res.origin
+
+	path := res.path
+	if origin.CacheKeyIgnoreCase {
+		path = strings.ToLower(path)
+	}
+	key := res.siteIdentifier + ":" + path
+
+	var params []string
+	if res.widthStr != "" || res.heightStr != "" {
+		params = append(params, "width="+res.widthStr, "height="+res.heightStr)
+	}
+	if origin.CacheKeyQueryParams != "" || origin.ForwardQueryParams != "" {
+		included := splitList(origin.CacheKeyQueryParams)
+		excluded := splitList(origin.CacheKeyExcludeParams)
+		forwarded := splitList(origin.ForwardQueryParams)
+		var selected, forwardedPairs []string
+		for _, pair := range strings.Split(rawQuery, "&") {
+			name, value, _ := strings.Cut(pair, "=")
+			name, err := url.QueryUnescape(name)
+			if err != nil || name == "" || name == "width" || name == "height" {
+				continue
+			}
+			forward := matchesList(forwarded, name)
+			if forward {
+				// Passed on exactly as sent, signatures may cover the encoding
+				forwardedPairs = append(forwardedPairs, pair)
+			} else if !matchesList(included, name) || matchesList(excluded, name) {
+				continue
+			}
+			value, err = url.QueryUnescape(value)
+			if err != nil {
+				// Forwarded all the same, so the key must tell such values apart
+				if forward {
+					selected = append(selected, pair)
+				}
+				continue
+			}
+			selected = append(selected, url.QueryEscape(name)+"="+url.QueryEscape(value))
+		}
+		if origin.CacheKeySortParams {
+			sort.Strings(selected)
+		}
+		params = append(params, selected...)
+		res.originQuery = strings.Join(forwardedPairs, "&")
+	}
+	if len(params) > 0 {
+		key += "?" + strings.Join(params, "&")
+	}
+
+	// Header and cookie values are hashed, they can be long
+	res.forwardHeaders = splitList(origin.ForwardHeaders)
+	headers := append(splitList(origin.CacheKeyHeaders), res.forwardHeaders...)
+	cookies := splitList(origin.CacheKeyCookies)
+	if len(headers) > 0 || len(cookies) > 0 {
+		h := sha256.New()
+		for _, name := range headers {
+			h.Write([]byte("h:" + http.CanonicalHeaderKey(name) + "=" + strings.Join(res.header.Values(name), ",") + "\n"))
+		}
+		request := &http.Request{Header: res.header}
+		for _, name := range cookies {
+			value := ""
+			if cookie, err := request.Cookie(name); err == nil {
+				value = cookie.Value
+			}
+			h.Write([]byte("c:" + name + "=" + value + "\n"))
+		}
+		key += "#key=" + hex.EncodeToString(h.Sum(nil))[:16]
+	}
+
+	res.cacheKey = key
+	res.baseKey = key
+}
+
+// splitList splits a comma separated setting, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// matchesList reports whether name is in a list of names, where "*" matches
+// everything and a trailing "*" matches a prefix.
+func matchesList(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if pattern == name {
+			return true
+		}
+	}
+	return false
+}
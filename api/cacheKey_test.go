@@ -0,0 +1,86 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/zhitoo/cdn/models"
+)
+
+func TestApplyCacheKeyPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		origin      models.OriginServer
+		path        string
+		header      http.Header
+		key         string
+		originQuery string
+	}{
+		{"no policy", models.OriginServer{}, "/a.png?utm_source=x&width=10", nil, "s:/a.png?width=10&height=", ""},
+		{"all params", models.OriginServer{CacheKeyQueryParams: "*"}, "/a.png?b=2&a=1", nil, "s:/a.png?b=2&a=1", ""},
+		{"sorted params", models.OriginServer{CacheKeyQueryParams: "*", CacheKeySortParams: true}, "/a.png?b=2&a=1", nil, "s:/a.png?a=1&b=2", ""},
+		{"excluded prefix", models.OriginServer{CacheKeyQueryParams: "*", CacheKeyExcludeParams: "utm_*"}, "/a.png?v=1&utm_source=x", nil, "s:/a.png?v=1", ""},
+		{"listed params", models.OriginServer{CacheKeyQueryParams: "v"}, "/a.png?v=1&w=2", nil, "s:/a.png?v=1", ""},
+		{"escaping", models.OriginServer{CacheKeyQueryParams: "*"}, "/a.png?q=a+b", nil, "s:/a.png?q=a+b", ""},
+		{"ignore case", models.OriginServer{CacheKeyIgnoreCase: true}, "/A.PNG", nil, "s:/a.png", ""},
+		{"forwarded", models.OriginServer{ForwardQueryParams: "token"}, "/a.png?token=a%2Fb&x=1", nil, "s:/a.png?token=a%2Fb", "token=a%2Fb"},
+		{"forwarded undecodable", models.OriginServer{ForwardQueryParams: "token"}, "/a.png?token=%zz", nil, "s:/a.png?token=%zz", "token=%zz"},
+		{"header", models.OriginServer{CacheKeyHeaders: "X-Device"}, "/a.png", http.Header{"X-Device": {"mobile"}}, "s:/a.png#key=", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, rawQuery, _ := strings.Cut(tt.path, "?")
+			query, _ := url.ParseQuery(rawQuery)
+			res, err := newResource("/s"+path, query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.origin = &tt.origin
+			res.header = tt.header
+			res.applyCacheKeyPolicy(rawQuery)
+			if strings.HasSuffix(tt.key, "#key=") {
+				if !strings.HasPrefix(res.cacheKey, tt.key) {
+					t.Errorf("key %q, want prefix %q", res.cacheKey, tt.key)
+				}
+			} else if res.cacheKey != tt.key {
+				t.Errorf("key %q, want %q", res.cacheKey, tt.key)
+			}
+			if res.baseKey != res.cacheKey {
+				t.Errorf("base key %q differs from key %q", res.baseKey, res.cacheKey)
+			}
+			if res.originQuery != tt.originQuery {
+				t.Errorf("origin query %q, want %q", res.originQuery, tt.originQuery)
+			}
+		})
+	}
+}
+
+func TestApplyCacheKeyPolicyDistinguishesValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		origin models.OriginServer
+		a, b   string
+		header [2]http.Header
+	}{
+		{"forwarded params", models.OriginServer{ForwardQueryParams: "token"}, "token=1", "token=2", [2]http.Header{}},
+		{"undecodable forwarded params", models.OriginServer{ForwardQueryParams: "token"}, "token=%zz", "token=%zy", [2]http.Header{}},
+		{"key headers", models.OriginServer{CacheKeyHeaders: "X-Device"}, "", "", [2]http.Header{{"X-Device": {"mobile"}}, {"X-Device": {"desktop"}}}},
+		{"forwarded headers", models.OriginServer{ForwardHeaders: "Authorization"}, "", "", [2]http.Header{{"Authorization": {"a"}}, {"Authorization": {"b"}}}},
+		{"key cookies", models.OriginServer{CacheKeyCookies: "lang"}, "", "", [2]http.Header{{"Cookie": {"lang=en"}}, {"Cookie": {"lang=fr"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var keys [2]string
+			for i, rawQuery := range []string{tt.a, tt.b} {
+				res := &resource{siteIdentifier: "s", path: "/a.png", origin: &tt.origin, header: tt.header[i]}
+				res.applyCacheKeyPolicy(rawQuery)
+				keys[i] = res.cacheKey
+			}
+			if keys[0] == keys[1] {
+				t.Errorf("both requests map to %q", keys[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zhitoo/cdn/config"
+)
+
+// How a response was served, sent in the X-Cache header
+const (
+	cacheHit         = "HIT"         // fresh entry from the cache
+	cacheStale       = "STALE"       // expired entry, while revalidating or while the origin fails
+	cacheMiss        = "MISS"        // fetched from the origin and cached
+	cacheExpired     = "EXPIRED"     // expired entry fetched again from the origin
+	cacheRevalidated = "REVALIDATED" // expired entry confirmed by the origin with a 304
+	cacheBypass      = "BYPASS"      // fetched from the origin, not cacheable
+)
+
+// setCacheStatus sets the X-Cache, RFC 9211 Cache-Status and Age headers of a
+// response served as entry.cacheStatus, and with CACHE_DEBUG_HEADERS the cache
+// key and the tier the entry came from.
+func setCacheStatus(c *fiber.Ctx, res *resource, entry *cachedEntry) {
+	status := entry.cacheStatus
+	c.Set("X-Cache", status)
+
+	cacheStatus := config.Envs.CacheName
+	switch status {
+	case cacheHit, cacheStale:
+		cacheStatus += "; hit"
+	case cacheMiss:
+		cacheStatus += "; fwd=uri-miss"
+	case cacheExpired:
+		cacheStatus += "; fwd=stale"
+	case cacheRevalidated:
+		cacheStatus += "; fwd=stale; fwd-status=304"
+	case cacheBypass:
+		cacheStatus += "; fwd=uri-miss"
+	}
+	if status == cacheMiss || status == cacheExpired || status == cacheBypass {
+		cacheStatus += fmt.Sprintf("; fwd-status=%d", entry.statusCode())
+	}
+	if status == cacheMiss || status == cacheExpired || status == cacheRevalidated {
+		cacheStatus += "; stored"
+	}
+	if entry.meta != nil && status != cacheBypass {
+		// Negative for stale entries
+		cacheStatus += fmt.Sprintf("; ttl=%d", entry.meta.ExpiresAt-time.Now().Unix())
+	}
+	if config.Envs.CacheDebugHeaders {
+		cacheStatus += fmt.Sprintf("; key=%q", res.cacheKey)
+	}
+	// Caches closer to the origin come first
+	if upstream := c.GetRespHeader("Cache-Status"); upstream != "" {
+		cacheStatus = upstream + ", " + cacheStatus
+	}
+	c.Set("Cache-Status", cacheStatus)
+
+	if (status == cacheHit || status == cacheStale) && entry.meta != nil {
+		c.Set("Age", strconv.FormatInt(entry.meta.Age(), 10))
+	}
+
+	if config.Envs.CacheDebugHeaders {
+		tier := entry.tier
+		if tier == "" {
+			tier = "origin"
+		}
+		if entry.filePath != "" {
+			tier += "+file"
+		}
+		c.Set("X-Cache-Key", res.cacheKey)
+		c.Set("X-Cache-Tier", tier)
+	}
+}
@@ -0,0 +1,25 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// getSurrogateKeys returns the cache tags an origin attached to a response, from
+// the space separated Surrogate-Key header and the comma separated Cache-Tag header.
+func getSurrogateKeys(header http.Header) []string {
+	var tags []string
+	seen := map[string]bool{}
+	values := append(header.Values("Surrogate-Key"), header.Values("Cache-Tag")...)
+	for _, value := range values {
+		for _, tag := range strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		}) {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
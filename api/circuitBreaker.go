@@ -0,0 +1,126 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zhitoo/cdn/config"
+	"github.com/zhitoo/cdn/models"
+)
+
+// errCircuitOpen means every origin of the site failed too often lately to be
+// tried. It is an errOriginUnavailable, so stale copies are served in its place.
+var errCircuitOpen = fmt.Errorf("%w: circuit open", errOriginUnavailable)
+
+// Circuit states of an origin
+const (
+	circuitClosed   = "closed"    // requests go through
+	circuitOpen     = "open"      // requests fail fast until the cooldown is over
+	circuitHalfOpen = "half_open" // one probe request decides whether to close again
+)
+
+// circuit is the circuit breaker of one origin.
+type circuit struct {
+	state    string
+	failures int       // consecutive failures
+	until    time.Time // end of the cooldown, or of the probe while half open
+}
+
+// circuitBreakers stop this process from sending requests to origins that keep
+// failing, until they recover.
+type circuitBreakers struct {
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+var breakers = &circuitBreakers{circuits: map[string]*circuit{}}
+
+// circuitSettings returns the failure threshold and the cooldown of the
+// circuit breaker of a site, a zero threshold when it is disabled.
+func circuitSettings(origin *models.OriginServer) (int, time.Duration) {
+	threshold, cooldown := origin.CircuitBreakerThreshold, origin.CircuitBreakerCooldown
+	if threshold == 0 {
+		threshold = config.Envs.CircuitBreakerThreshold
+	}
+	if cooldown == 0 {
+		cooldown = config.Envs.CircuitBreakerCooldown
+	}
+	if threshold < 0 {
+		threshold = 0
+	}
+	return int(threshold), time.Duration(cooldown) * time.Second
+}
+
+// allow reports whether a request may be sent to an origin. Once the cooldown
+// of an open circuit is over, the next request is let through as a probe and
+// the others keep failing fast until its outcome is recorded.
+func (b *circuitBreakers) allow(key string, origin *models.OriginServer) bool {
+	threshold, cooldown := circuitSettings(origin)
+	if threshold == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[key]
+	if !ok || c.state == circuitClosed {
+		return true
+	}
+	// A probe that never reported back does not keep the circuit half open
+	if time.Now().Before(c.until) {
+		return false
+	}
+	if c.state == circuitOpen {
+		log.Printf("Circuit of origin %s is half open, sending a probe request", key)
+	}
+	c.state = circuitHalfOpen
+	c.until = time.Now().Add(cooldown)
+	return true
+}
+
+// success records a request the origin answered, closing its circuit.
+func (b *circuitBreakers) success(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[key]
+	if !ok {
+		return
+	}
+	if c.state != circuitClosed {
+		log.Printf("Circuit of origin %s is closed again", key)
+	}
+	delete(b.circuits, key)
+}
+
+// failure records a failed request, opening the circuit of the origin after
+// the threshold of consecutive failures, or at once when a probe failed.
+func (b *circuitBreakers) failure(key string, origin *models.OriginServer) {
+	threshold, cooldown := circuitSettings(origin)
+	if threshold == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[key]
+	if !ok {
+		c = &circuit{state: circuitClosed}
+		b.circuits[key] = c
+	}
+	c.failures++
+	if c.state == circuitHalfOpen || (c.state == circuitClosed && c.failures >= threshold) {
+		log.Printf("Circuit of origin %s is open after %d failures in a row", key, c.failures)
+		c.state = circuitOpen
+		c.until = time.Now().Add(cooldown)
+	}
+}
+
+// state returns the circuit state of an origin.
+func (b *circuitBreakers) state(key string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, ok := b.circuits[key]; ok {
+		return c.state
+	}
+	return circuitClosed
+}
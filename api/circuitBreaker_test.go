@@ -0,0 +1,106 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zhitoo/cdn/models"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	// Each step is "allow", "failure", "success" or "cooldown", which ends the
+	// cooldown of the circuit. allowed is the outcome of the allow steps, state
+	// the state after the last step.
+	tests := []struct {
+		name      string
+		threshold int64
+		steps     []string
+		allowed   []bool
+		state     string
+	}{
+		{
+			name:      "closed below the threshold",
+			threshold: 3,
+			steps:     []string{"failure", "failure", "allow"},
+			allowed:   []bool{true},
+			state:     circuitClosed,
+		},
+		{
+			name:      "success resets the failures",
+			threshold: 3,
+			steps:     []string{"failure", "failure", "success", "failure", "failure", "allow"},
+			allowed:   []bool{true},
+			state:     circuitClosed,
+		},
+		{
+			name:      "opens at the threshold and fails fast",
+			threshold: 2,
+			steps:     []string{"failure", "failure", "allow", "allow"},
+			allowed:   []bool{false, false},
+			state:     circuitOpen,
+		},
+		{
+			name:      "single probe after the cooldown",
+			threshold: 2,
+			steps:     []string{"failure", "failure", "cooldown", "allow", "allow"},
+			allowed:   []bool{true, false},
+			state:     circuitHalfOpen,
+		},
+		{
+			name:      "probe success closes",
+			threshold: 2,
+			steps:     []string{"failure", "failure", "cooldown", "allow", "success", "allow"},
+			allowed:   []bool{true, true},
+			state:     circuitClosed,
+		},
+		{
+			name:      "probe failure reopens",
+			threshold: 2,
+			steps:     []string{"failure", "failure", "cooldown", "allow", "failure", "allow"},
+			allowed:   []bool{true, false},
+			state:     circuitOpen,
+		},
+		{
+			name:      "lost probe lets another one through",
+			threshold: 2,
+			steps:     []string{"failure", "failure", "cooldown", "allow", "cooldown", "allow"},
+			allowed:   []bool{true, true},
+			state:     circuitHalfOpen,
+		},
+		{
+			name:      "disabled",
+			threshold: -1,
+			steps:     []string{"failure", "failure", "failure", "allow"},
+			allowed:   []bool{true},
+			state:     circuitClosed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &circuitBreakers{circuits: map[string]*circuit{}}
+			origin := &models.OriginServer{CircuitBreakerThreshold: tt.threshold, CircuitBreakerCooldown: 30}
+			const key = "site#origin"
+			var allowed []bool
+			for _, step := range tt.steps {
+				switch step {
+				case "allow":
+					allowed = append(allowed, b.allow(key, origin))
+				case "failure":
+					b.failure(key, origin)
+				case "success":
+					b.success(key)
+				case "cooldown":
+					b.circuits[key].until = time.Now().Add(-time.Second)
+				}
+			}
+			for i := range tt.allowed {
+				if i >= len(allowed) || allowed[i] != tt.allowed[i] {
+					t.Fatalf("allowed = %v, want %v", allowed, tt.allowed)
+				}
+			}
+			if got := b.state(key); got != tt.state {
+				t.Errorf("state = %s, want %s", got, tt.state)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zhitoo/cdn/cache"
+	"github.com/zhitoo/cdn/config"
+)
+
+// isConditional reports whether a request may be answered with 304 Not Modified.
+func isConditional(c *fiber.Ctx) bool {
+	return c.Get("If-None-Match") != "" || c.Get("If-Modified-Since") != ""
+}
+
+// notModified reports whether a GET or HEAD request can be answered with 304
+// Not Modified. If-None-Match is evaluated before If-Modified-Since, which is
+// ignored when both are sent, as RFC 9110 requires.
+func notModified(c *fiber.Ctx, meta *cache.Meta) bool {
+	if meta == nil {
+		return false
+	}
+	if ifNoneMatch := c.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := entryETag(meta)
+		return etag != "" && etagMatches(ifNoneMatch, etag)
+	}
+	ifModifiedSince := c.Get("If-Modified-Since")
+	if ifModifiedSince == "" || meta.LastModified == "" {
+		return false
+	}
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(meta.LastModified)
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(since)
+}
+
+// lookupMeta is lookupEntry for the metadata alone, the body is not read.
+func lookupMeta(store cache.CacheStore, res *resource) *cache.Meta {
+	meta, err := store.Stat(res.cacheKey)
+	if err != nil {
+		log.Printf("Error reading %s from the cache: %v", res.cacheKey, err)
+		return nil
+	}
+	if meta == nil || len(meta.Vary) == 0 {
+		return meta
+	}
+	res.vary = meta.Vary
+	res.cacheKey = variantKey(res.baseKey, res.vary, res.header)
+	meta, err = store.Stat(res.cacheKey)
+	if err != nil {
+		log.Printf("Error reading %s from the cache: %v", res.cacheKey, err)
+		return nil
+	}
+	return meta
+}
+
+// serveFromMeta answers HEAD requests and matching conditional requests for a
+// fresh entry from its metadata, without reading the body from the cache. It
+// returns false when the full entry is needed.
+func serveFromMeta(c *fiber.Ctx, store cache.CacheStore, res *resource) (bool, error) {
+	meta := lookupMeta(store, res)
+	if meta == nil || !meta.IsFresh() {
+		return false, nil
+	}
+	entry := &cachedEntry{meta: meta, cacheStatus: cacheHit, tier: config.Envs.CacheStore}
+	if entry.statusCode() != http.StatusOK {
+		return false, nil
+	}
+
+	switch {
+	case notModified(c, meta):
+		replayHeaders(c, meta)
+		setCacheStatus(c, res, entry)
+		return true, c.SendStatus(fiber.StatusNotModified)
+	case c.Method() == fiber.MethodHead && meta.ContentHash != "":
+		// Entries stored before their size was recorded are read in full
+		replayHeaders(c, meta)
+		setCacheStatus(c, res, entry)
+		c.Set("Content-Type", entryContentType(entry, res.path, nil))
+		c.Set("Accept-Ranges", "bytes")
+		c.Response().Header.SetContentLength(int(meta.Size))
+		return true, nil
+	}
+	return false, nil
+}
+
+// proxyHead answers a HEAD request for an uncached resource with a HEAD request
+// to the origin, leaving the body to be cached by the first GET.
+func proxyHead(c *fiber.Ctx, res *resource) error {
+	resp, err := fetchFromOrigin(res, http.MethodHead, nil)
+	if err != nil {
+		return sendFetchError(c, err)
+	}
+	return proxyResponse(c, res, resp)
+}
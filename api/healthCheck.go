@@ -0,0 +1,279 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zhitoo/cdn/config"
+	"github.com/zhitoo/cdn/health"
+	"github.com/zhitoo/cdn/models"
+)
+
+// Defaults of the health check settings of an origin
+const (
+	defaultHealthCheckInterval = 10 // seconds
+	defaultHealthCheckStatus   = http.StatusOK
+	defaultHealthyThreshold    = 2
+	defaultUnhealthyThreshold  = 3
+)
+
+// healthClient probes origins, redirects count as answers
+var healthClient = &http.Client{
+	Timeout: time.Duration(config.Envs.HealthCheckTimeout) * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// healthView is the copy of the health store the fetch path reads, refreshed
+// by the health checker every second.
+type healthView struct {
+	mu     sync.RWMutex
+	states map[string]*health.State
+}
+
+var originHealth = &healthView{states: map[string]*health.State{}}
+
+// healthy reports whether an origin is not known to fail its health checks.
+func (v *healthView) healthy(healthKey string) bool {
+	if healthKey == "" {
+		return true
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	state, ok := v.states[healthKey]
+	return !ok || state.Healthy
+}
+
+// healthCheck is an origin with its health check settings.
+type healthCheck struct {
+	site      *models.OriginServer
+	target    originTarget
+	url       string
+	interval  time.Duration
+	status    int
+	healthy   int
+	unhealthy int
+}
+
+// healthChecks returns the origins of site pools that have a health check.
+func healthChecks(sites []*models.OriginServer) []*healthCheck {
+	var checks []*healthCheck
+	for _, site := range sites {
+		targets, err := originTargets(site)
+		if err != nil {
+			continue
+		}
+		for _, target := range targets {
+			o := target.config
+			if o == nil || o.HealthCheckPath == "" {
+				continue
+			}
+			check := &healthCheck{
+				site:      site,
+				target:    target,
+				url:       target.baseURL + o.HealthCheckPath,
+				interval:  time.Duration(o.HealthCheckInterval) * time.Second,
+				status:    o.HealthCheckStatus,
+				healthy:   o.HealthyThreshold,
+				unhealthy: o.UnhealthyThreshold,
+			}
+			if check.interval <= 0 {
+				check.interval = defaultHealthCheckInterval * time.Second
+			}
+			if check.status == 0 {
+				check.status = defaultHealthCheckStatus
+			}
+			if check.healthy == 0 {
+				check.healthy = defaultHealthyThreshold
+			}
+			if check.unhealthy == 0 {
+				check.unhealthy = defaultUnhealthyThreshold
+			}
+			checks = append(checks, check)
+		}
+	}
+	return checks
+}
+
+// StartHealthChecker probes the origins of every site pool with a health check
+// path and keeps the health of the origins this process uses up to date. Each
+// probe is claimed in the health store, so with Redis an origin is probed once
+// per interval for all nodes together.
+func (s *APIServer) StartHealthChecker() {
+	ticker := time.NewTicker(time.Second)
+	go func() {
+		var checks []*healthCheck
+		var loadedAt time.Time
+		nextProbe := map[string]time.Time{}
+		for range ticker.C {
+			// Pick up sites registered since the last load
+			if time.Since(loadedAt) >= 10*time.Second {
+				sites, err := s.storage.GetOriginServers()
+				if err != nil {
+					log.Printf("Error loading origin servers for health checks: %v", err)
+				} else {
+					checks = healthChecks(sites)
+					loadedAt = time.Now()
+				}
+			}
+
+			keys := make([]string, 0, len(checks))
+			for _, check := range checks {
+				key := check.target.healthKey
+				keys = append(keys, key)
+				if time.Now().Before(nextProbe[key]) {
+					continue
+				}
+				nextProbe[key] = time.Now().Add(check.interval)
+				claimed, err := s.health.Claim(key, check.interval)
+				if err != nil {
+					log.Printf("Error claiming health check of %s: %v", check.url, err)
+					continue
+				}
+				if claimed {
+					go s.probe(check)
+				}
+			}
+
+			states, err := s.health.Get(keys)
+			if err != nil {
+				log.Printf("Error reading origin health: %v", err)
+				continue
+			}
+			originHealth.mu.Lock()
+			originHealth.states = states
+			originHealth.mu.Unlock()
+		}
+	}()
+}
+
+// probe runs one health check and records its outcome.
+func (s *APIServer) probe(check *healthCheck) {
+	key := check.target.healthKey
+	states, err := s.health.Get([]string{key})
+	if err != nil {
+		log.Printf("Error reading origin health: %v", err)
+		return
+	}
+	state, ok := states[key]
+	if !ok {
+		state = &health.State{Origin: key, Healthy: true}
+	}
+
+	state.CheckedAt = time.Now().Unix()
+	state.StatusCode, state.Error = 0, ""
+	passed := false
+	req, err := http.NewRequest(http.MethodGet, check.url, nil)
+	if err == nil {
+		if check.site.OriginHost != "" {
+			req.Host = check.site.OriginHost
+		}
+		var resp *http.Response
+		resp, err = healthClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			state.StatusCode = resp.StatusCode
+			passed = resp.StatusCode == check.status
+		}
+	}
+	if err != nil {
+		state.Error = err.Error()
+	}
+
+	if passed {
+		state.Successes++
+		state.Failures = 0
+		if !state.Healthy && state.Successes >= check.healthy {
+			state.Healthy = true
+			log.Printf("Origin %s is healthy again", check.target.baseURL)
+		}
+	} else {
+		state.Failures++
+		state.Successes = 0
+		if state.Healthy && state.Failures >= check.unhealthy {
+			state.Healthy = false
+			if state.Error != "" {
+				log.Printf("Origin %s is unhealthy: %s", check.target.baseURL, state.Error)
+			} else {
+				log.Printf("Origin %s is unhealthy: status %d", check.target.baseURL, state.StatusCode)
+			}
+		}
+	}
+
+	// Forget origins that are no longer checked
+	if err := s.health.Set(state, max(10*check.interval, time.Minute)); err != nil {
+		log.Printf("Error storing origin health: %v", err)
+	}
+}
+
+// originHealthStatus handles GET /health/origins, listing the origin pools of
+// all sites, or of the site given as ?site=, with the health of each origin and
+// the state of its circuit breaker in this process.
+func (s *APIServer) originHealthStatus(c *fiber.Ctx) error {
+	if !validAPIKey(c.Get("X-API-Key")) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	sites, err := s.storage.GetOriginServers()
+	if err != nil {
+		return err
+	}
+
+	type originStatus struct {
+		URL      string        `json:"url"`
+		Weight   int           `json:"weight"`
+		Priority int           `json:"priority"`
+		Checked  bool          `json:"checked"`
+		Healthy  bool          `json:"healthy"`
+		Circuit  string        `json:"circuit"`
+		State    *health.State `json:"state,omitempty"`
+	}
+	result := map[string][]originStatus{}
+	for _, site := range sites {
+		if c.Query("site") != "" && c.Query("site") != site.SiteIdentifier {
+			continue
+		}
+		targets, err := originTargets(site)
+		if err != nil {
+			continue
+		}
+		var keys []string
+		for _, target := range targets {
+			if target.healthKey != "" {
+				keys = append(keys, target.healthKey)
+			}
+		}
+		states, err := s.health.Get(keys)
+		if err != nil {
+			return err
+		}
+
+		statuses := []originStatus{}
+		for _, target := range targets {
+			status := originStatus{
+				URL:      target.baseURL,
+				Weight:   target.weight,
+				Priority: target.priority,
+				Checked:  target.config != nil && target.config.HealthCheckPath != "",
+				Healthy:  true,
+				Circuit:  breakers.state(target.circuitKey),
+			}
+			if state, ok := states[target.healthKey]; ok {
+				status.Healthy = state.Healthy
+				status.State = state
+			}
+			statuses = append(statuses, status)
+		}
+		result[site.SiteIdentifier] = statuses
+	}
+
+	return c.JSON(fiber.Map{
+		"sites": result,
+	})
+}
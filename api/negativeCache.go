@@ -0,0 +1,91 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/zhitoo/cdn/cache"
+	"github.com/zhitoo/cdn/config"
+	"github.com/zhitoo/cdn/models"
+)
+
+// negativeCacheTTL returns how long an origin error response with status may be
+// cached for a site, zero when it is not cached at all.
+func negativeCacheTTL(origin *models.OriginServer, status int) time.Duration {
+	var siteTTL, defaultTTL int64
+	switch {
+	case status == http.StatusNotFound || status == http.StatusGone:
+		siteTTL, defaultTTL = origin.NegativeCacheTTL, config.Envs.NegativeCacheTTL
+	case status >= http.StatusInternalServerError:
+		siteTTL, defaultTTL = origin.ErrorCacheTTL, config.Envs.ErrorCacheTTL
+	default:
+		return 0
+	}
+	if siteTTL < 0 {
+		return 0
+	}
+	if siteTTL == 0 {
+		siteTTL = defaultTTL
+	}
+	return time.Duration(max(siteTTL, 0)) * time.Second
+}
+
+// processErrorResponse turns an origin response other than 200 into an entry
+// served with the origin status code, headers and body. 404, 410 and 5xx
+// responses are cached for a short time so missing files do not hit the origin
+// every time. Bodies too large to cache are streamed when stream is set.
+func processErrorResponse(store cache.CacheStore, res *resource, resp *http.Response, stream bool) (*cachedEntry, error) {
+	log.Printf("Origin responded to %s with status %d", resp.Request.URL, resp.StatusCode)
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRedisValueSize+1))
+	if err != nil {
+		log.Printf("Error reading origin response: %v", err)
+		return nil, originError(err)
+	}
+	fits := len(body) <= maxRedisValueSize
+
+	// The origin may shorten the TTL or forbid caching altogether
+	ttl := negativeCacheTTL(res.origin, resp.StatusCode)
+	headerTTL, cacheable := getCacheExpireTime(resp.Header, ttl)
+	ttl = min(ttl, headerTTL)
+
+	meta := &cache.Meta{
+		StoredAt:    time.Now().Unix(),
+		ExpiresAt:   time.Now().Add(ttl).Unix(),
+		Tags:        getSurrogateKeys(resp.Header),
+		StatusCode:  resp.StatusCode,
+		Header:      storedHeaders(resp.Header),
+		ContentType: originContentType(resp.Header, http.DetectContentType(body)),
+		FetchedAt:   time.Now().Unix(),
+	}
+	rewriteLocation(meta.Header, res, resp.Request.URL)
+
+	if !fits {
+		if !stream {
+			return &cachedEntry{meta: meta, cacheStatus: cacheBypass}, nil
+		}
+		return &cachedEntry{stream: struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}, contentType: meta.ContentType, contentLength: resp.ContentLength, meta: meta, cacheStatus: cacheBypass}, nil
+	}
+	meta.Size = int64(len(body))
+	meta.ContentHash = contentHash(body)
+	if !cacheable || ttl <= 0 {
+		return &cachedEntry{content: body, meta: meta, cacheStatus: cacheBypass}, nil
+	}
+	// The error stands for every variant of the resource
+	storeContentEntry(store, res.baseKey, body, meta, ttl)
+	return &cachedEntry{content: body, meta: meta, cacheStatus: cacheMiss}, nil
+}
+
+// statusCode returns the origin status code the entry is served with.
+func (e *cachedEntry) statusCode() int {
+	if e.meta == nil || e.meta.StatusCode == 0 {
+		return http.StatusOK
+	}
+	return e.meta.StatusCode
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zhitoo/cdn/models"
+)
+
+// The defaults are NEGATIVE_CACHE_TTL=60 and ERROR_CACHE_TTL=0.
+func TestNegativeCacheTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		origin models.OriginServer
+		status int
+		want   time.Duration
+	}{
+		{"404 default", models.OriginServer{}, 404, time.Minute},
+		{"410 default", models.OriginServer{}, 410, time.Minute},
+		{"404 site TTL", models.OriginServer{NegativeCacheTTL: 5}, 404, 5 * time.Second},
+		{"404 disabled", models.OriginServer{NegativeCacheTTL: -1}, 404, 0},
+		{"5xx default", models.OriginServer{}, 503, 0},
+		{"5xx site TTL", models.OriginServer{ErrorCacheTTL: 10}, 500, 10 * time.Second},
+		{"5xx disabled", models.OriginServer{ErrorCacheTTL: -1}, 502, 0},
+		{"other status", models.OriginServer{NegativeCacheTTL: 5, ErrorCacheTTL: 5}, 403, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negativeCacheTTL(&tt.origin, tt.status); got != tt.want {
+				t.Errorf("negativeCacheTTL(%d) = %v, want %v", tt.status, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zhitoo/cdn/cache"
+)
+
+// unstoredHeaders are origin response headers that are not kept with a cached
+// entry: hop-by-hop headers, headers describing the transfer rather than the
+// resource, headers the CDN sets itself and headers only meant for the CDN.
+var unstoredHeaders = map[string]bool{
+	"Connection":                true,
+	"Keep-Alive":                true,
+	"Proxy-Connection":          true,
+	"Proxy-Authenticate":        true,
+	"Te":                        true,
+	"Trailer":                   true,
+	"Transfer-Encoding":         true,
+	"Upgrade":                   true,
+	"Content-Length":            true,
+	"Content-Range":             true,
+	"Accept-Ranges":             true,
+	"Content-Type":              true, // kept in cache.Meta.ContentType
+	"Etag":                      true, // kept in cache.Meta.ETag
+	"Last-Modified":             true, // kept in cache.Meta.LastModified
+	"Date":                      true,
+	"Age":                       true,
+	"Warning":                   true,
+	"Set-Cookie":                true, // never share one client's cookies with another
+	"Surrogate-Control":         true,
+	"Surrogate-Key":             true,
+	"Cache-Tag":                 true,
+	"Alt-Svc":                   true,
+	"Strict-Transport-Security": true,
+}
+
+// storedHeaders returns the origin response headers to keep with a cached entry.
+func storedHeaders(header http.Header) http.Header {
+	// Headers named in Connection are hop-by-hop as well
+	hopByHop := map[string]bool{}
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			hopByHop[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	stored := http.Header{}
+	for name, values := range header {
+		if unstoredHeaders[name] || hopByHop[name] {
+			continue
+		}
+		stored[name] = append([]string(nil), values...)
+	}
+	return stored
+}
+
+// updateStoredHeaders merges the headers of a 304 revalidation response into the
+// stored headers, as RFC 9111 section 4.3.4 describes.
+func updateStoredHeaders(stored, header http.Header) http.Header {
+	updated := stored.Clone()
+	if updated == nil {
+		updated = http.Header{}
+	}
+	for name, values := range storedHeaders(header) {
+		updated[name] = values
+	}
+	return updated
+}
+
+// entryETag returns the ETag of a cached entry: the one of the origin, or one
+// derived from the hash of the cached body when the origin sent none. It is
+// weak, the body may still be compressed for the client.
+func entryETag(meta *cache.Meta) string {
+	if meta.ETag != "" || meta.ContentHash == "" {
+		return meta.ETag
+	}
+	return `W/"` + meta.ContentHash[:16] + `"`
+}
+
+// replayHeaders sets the stored origin headers of an entry on the response.
+func replayHeaders(c *fiber.Ctx, meta *cache.Meta) {
+	if meta == nil {
+		return
+	}
+	for name, values := range meta.Header {
+		c.Response().Header.Del(name)
+		for _, value := range values {
+			c.Response().Header.Add(name, value)
+		}
+	}
+	if etag := entryETag(meta); etag != "" {
+		c.Set("ETag", etag)
+	}
+	if meta.LastModified != "" {
+		c.Set("Last-Modified", meta.LastModified)
+	}
+}
+
+// entryContentType returns the content type of a cached entry, falling back to
+// the path and the first bytes of the body for entries stored without one.
+func entryContentType(entry *cachedEntry, path string, content []byte) string {
+	if entry.meta != nil && entry.meta.ContentType != "" {
+		return entry.meta.ContentType
+	}
+	return getContentType(path, content)
+}
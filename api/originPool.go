@@ -0,0 +1,374 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zhitoo/cdn/config"
+	"github.com/zhitoo/cdn/models"
+)
+
+// originTarget is one origin of the pool of a site.
+type originTarget struct {
+	baseURL  string
+	weight   int
+	priority int
+
+	// healthKey identifies the origin in the health store, config is the pool
+	// entry with its health check settings (nil for OriginURL)
+	healthKey string
+	config    *models.Origin
+	// circuitKey identifies the origin in the circuit breakers
+	circuitKey string
+}
+
+// originTargets returns the origin pool of a site: its Origins, or OriginURL
+// alone when it has none.
+func originTargets(origin *models.OriginServer) ([]originTarget, error) {
+	if len(origin.Origins) == 0 {
+		baseURL, err := originBaseURL(origin, origin.OriginURL)
+		if err != nil {
+			return nil, err
+		}
+		return []originTarget{{
+			baseURL:    baseURL,
+			weight:     1,
+			circuitKey: origin.SiteIdentifier + " " + baseURL,
+		}}, nil
+	}
+
+	targets := make([]originTarget, 0, len(origin.Origins))
+	for i, o := range origin.Origins {
+		baseURL, err := originBaseURL(origin, o.URL)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, originTarget{
+			baseURL:    baseURL,
+			weight:     max(o.Weight, 1),
+			priority:   o.Priority,
+			healthKey:  origin.SiteIdentifier + " " + baseURL,
+			config:     &origin.Origins[i],
+			circuitKey: origin.SiteIdentifier + " " + baseURL,
+		})
+	}
+	return targets, nil
+}
+
+// originBalancer spreads the requests of this process over the origins of each
+// site.
+type originBalancer struct {
+	mu     sync.Mutex
+	next   map[string]uint64 // round-robin position per site, priority and health
+	active map[string]int    // requests in flight per origin
+}
+
+var balancer = &originBalancer{
+	next:   map[string]uint64{},
+	active: map[string]int{},
+}
+
+// order returns the origins of a resource in the order they are tried. Lower
+// priorities come first, the first origin of each priority is chosen by the
+// load balancing method of the site and the others follow as fallbacks. Origins
+// failing their health checks are only tried when all the others failed.
+func (b *originBalancer) order(res *resource) []originTarget {
+	// Failing origins go last, and are balanced apart from the healthy ones of
+	// the same priority, so one is never chosen before a healthy origin
+	var healthy, down []originTarget
+	for _, target := range res.targets {
+		if originHealth.healthy(target.healthKey) {
+			healthy = append(healthy, target)
+		} else {
+			down = append(down, target)
+		}
+	}
+	return append(b.orderByPriority(res, healthy, ""), b.orderByPriority(res, down, "#down")...)
+}
+
+// orderByPriority sorts origins by priority and orders each priority in place.
+// set names the set of origins for the round-robin positions.
+func (b *originBalancer) orderByPriority(res *resource, targets []originTarget, set string) []originTarget {
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].priority < targets[j].priority
+	})
+	for start := 0; start < len(targets); {
+		end := start
+		for end < len(targets) && targets[end].priority == targets[start].priority {
+			end++
+		}
+		b.orderGroup(res, targets[start:end], set)
+		start = end
+	}
+	return targets
+}
+
+// orderGroup orders origins of the same priority in place.
+func (b *originBalancer) orderGroup(res *resource, group []originTarget, set string) {
+	if len(group) < 2 {
+		return
+	}
+	switch res.origin.LoadBalancing {
+	case "least_connections":
+		b.mu.Lock()
+		load := make(map[string]float64, len(group))
+		for _, target := range group {
+			load[target.baseURL] = float64(b.active[target.baseURL]) / float64(target.weight)
+		}
+		b.mu.Unlock()
+		sort.SliceStable(group, func(i, j int) bool {
+			return load[group[i].baseURL] < load[group[j].baseURL]
+		})
+	case "consistent_hash":
+		// Weighted rendezvous hashing: every resource keeps going to the same
+		// origin, and only the resources of a failed origin move elsewhere
+		score := make(map[string]float64, len(group))
+		for _, target := range group {
+			h := fnv.New64a()
+			h.Write([]byte(res.baseKey + "\x00" + target.baseURL))
+			u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+			score[target.baseURL] = -float64(target.weight) / math.Log(u)
+		}
+		sort.SliceStable(group, func(i, j int) bool {
+			return score[group[i].baseURL] > score[group[j].baseURL]
+		})
+	default:
+		// Weighted round robin, starting the rotation at the chosen origin
+		total := 0
+		for _, target := range group {
+			total += target.weight
+		}
+		key := res.siteIdentifier + "#" + strconv.Itoa(group[0].priority) + set
+		b.mu.Lock()
+		position := int(b.next[key] % uint64(total))
+		b.next[key]++
+		b.mu.Unlock()
+
+		chosen := 0
+		for position >= group[chosen].weight {
+			position -= group[chosen].weight
+			chosen++
+		}
+		rotated := append(append([]originTarget(nil), group[chosen:]...), group[:chosen]...)
+		copy(group, rotated)
+	}
+}
+
+// acquire counts a request in flight to an origin, until release is called.
+func (b *originBalancer) acquire(target originTarget) (release func()) {
+	b.mu.Lock()
+	b.active[target.baseURL]++
+	b.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			b.active[target.baseURL]--
+			b.mu.Unlock()
+		})
+	}
+}
+
+// originBody is the body of an origin response. The origin may stay silent
+// for the read timeout of its site during each read, and the request is
+// released once the body is closed.
+type originBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	timer   *time.Timer
+	timeout time.Duration
+	release func()
+}
+
+// Read reports errOriginTimeout when the read timeout cut the body off.
+func (b *originBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	defer b.timer.Stop()
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && errors.Is(context.Cause(b.ctx), errOriginTimeout) {
+		err = errOriginTimeout
+	}
+	return n, err
+}
+
+func (b *originBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// originTransport is the default transport, connecting with dialOrigin.
+func originTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialOrigin
+	return transport
+}
+
+// connectTimeoutKey carries the connect timeout of a site in the context of
+// its origin requests, for dialOrigin.
+type connectTimeoutKey struct{}
+
+// dialOrigin connects to an origin within the connect timeout of its site.
+func dialOrigin(ctx context.Context, network, addr string) (net.Conn, error) {
+	timeout, _ := ctx.Value(connectTimeoutKey{}).(time.Duration)
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// originTimeouts returns the connect and read timeouts of a site.
+func originTimeouts(origin *models.OriginServer) (connect, read time.Duration) {
+	connectTimeout, readTimeout := origin.OriginConnectTimeout, origin.OriginReadTimeout
+	if connectTimeout == 0 {
+		connectTimeout = config.Envs.OriginConnectTimeout
+	}
+	if readTimeout == 0 {
+		readTimeout = config.Envs.OriginReadTimeout
+	}
+	return time.Duration(connectTimeout) * time.Second, time.Duration(readTimeout) * time.Second
+}
+
+// originRetries returns how many times a failed request to the origins of a
+// site is retried. Only idempotent requests are retried.
+func originRetries(origin *models.OriginServer, method string) int {
+	if method != http.MethodGet && method != http.MethodHead {
+		return 0
+	}
+	retries := origin.OriginRetries
+	if retries == 0 {
+		retries = config.Envs.OriginRetries
+	}
+	return int(max(retries, 0))
+}
+
+// retryBackoff is the delay before the given retry, starting at 1: the retry
+// backoff doubled for each retry, of which a random half is waited, so that
+// the requests failing together do not all come back at the same moment.
+func retryBackoff(retry int) time.Duration {
+	backoff := time.Duration(config.Envs.OriginRetryBackoff) * time.Millisecond << (retry - 1)
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// fetchFromOrigin sends a request for the resource to the origins of its site,
+// failing over to the next one when an origin cannot be reached, times out or
+// answers with a 502, 503 or 504. When every origin failed, idempotent requests
+// are retried after a backoff. Origins whose circuit is open are skipped.
+// prepare may add headers to each request. When every attempt fails, the
+// response of the last one is returned, or the last error.
+func fetchFromOrigin(res *resource, method string, prepare func(req *http.Request)) (*http.Response, error) {
+	targets := balancer.order(res)
+	retries := originRetries(res.origin, method)
+	var lastResp *http.Response
+	lastErr := errCircuitOpen
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryBackoff(attempt))
+		}
+		tried := false
+		for _, target := range targets {
+			if !breakers.allow(target.circuitKey, res.origin) {
+				continue
+			}
+			tried = true
+			req, err := newOriginRequest(method, res, target)
+			if err != nil {
+				return nil, err
+			}
+			if prepare != nil {
+				prepare(req)
+			}
+
+			resp, err := sendToOrigin(res, target, req)
+			if lastResp != nil {
+				lastResp.Body.Close()
+				lastResp = nil
+			}
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if originFailed(resp.StatusCode) {
+				log.Printf("Origin responded to %s with status %d", req.URL, resp.StatusCode)
+				lastResp = resp
+				continue
+			}
+			return resp, nil
+		}
+		// Fail fast while the circuits of all origins are open
+		if !tried {
+			break
+		}
+	}
+	if lastResp != nil {
+		return lastResp, nil
+	}
+	return nil, lastErr
+}
+
+// originFailed reports whether a status code means the origin failed to
+// handle the request, rather than answered it. Other 5xx, like a 500, are the
+// answer of the origin and are passed on without failing over.
+func originFailed(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// sendToOrigin sends a request to one origin of the resource's site, within
+// the timeouts of the site, and records the outcome in the circuit breaker of
+// the origin.
+func sendToOrigin(res *resource, target originTarget, req *http.Request) (*http.Response, error) {
+	connectTimeout, readTimeout := originTimeouts(res.origin)
+	ctx, cancel := context.WithCancelCause(context.WithValue(req.Context(), connectTimeoutKey{}, connectTimeout))
+	timer := time.AfterFunc(readTimeout, func() { cancel(errOriginTimeout) })
+	req = req.WithContext(ctx)
+
+	release := balancer.acquire(target)
+	resp, err := originClient.Do(req)
+	timer.Stop()
+	if err != nil {
+		log.Printf("Error fetching %s from origin: %v", req.URL, err)
+		if errors.Is(context.Cause(ctx), errOriginTimeout) {
+			err = errOriginTimeout
+		} else {
+			err = originError(err)
+		}
+		cancel(nil)
+		release()
+		breakers.failure(target.circuitKey, res.origin)
+		return nil, err
+	}
+
+	if originFailed(resp.StatusCode) {
+		breakers.failure(target.circuitKey, res.origin)
+	} else {
+		breakers.success(target.circuitKey)
+	}
+	resp.Body = &originBody{
+		ReadCloser: resp.Body,
+		ctx:        ctx,
+		timer:      timer,
+		timeout:    readTimeout,
+		release: func() {
+			cancel(nil)
+			release()
+		},
+	}
+	return resp, nil
+}
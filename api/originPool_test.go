@@ -0,0 +1,119 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/zhitoo/cdn/health"
+	"github.com/zhitoo/cdn/models"
+)
+
+func TestOriginBalancerOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins []models.Origin
+		method  string
+		down    []string
+		// firsts are the origins tried first by consecutive requests, last the
+		// origin always tried last
+		firsts []string
+		last   string
+	}{
+		{
+			name:    "round robin",
+			origins: []models.Origin{{URL: "a"}, {URL: "b"}, {URL: "c"}},
+			firsts:  []string{"a", "b", "c", "a"},
+		},
+		{
+			name:    "weights",
+			origins: []models.Origin{{URL: "a", Weight: 2}, {URL: "b"}},
+			firsts:  []string{"a", "a", "b", "a"},
+		},
+		{
+			name:    "priorities",
+			origins: []models.Origin{{URL: "backup", Priority: 1}, {URL: "a"}, {URL: "b"}},
+			firsts:  []string{"a", "b", "a"},
+			last:    "backup",
+		},
+		{
+			name:    "unhealthy origin",
+			origins: []models.Origin{{URL: "a"}, {URL: "b"}, {URL: "c"}},
+			down:    []string{"b"},
+			firsts:  []string{"a", "c", "a", "c", "a", "c"},
+			last:    "b",
+		},
+		{
+			name:    "unhealthy before fallbacks",
+			origins: []models.Origin{{URL: "a"}, {URL: "backup", Priority: 1}},
+			down:    []string{"a"},
+			firsts:  []string{"backup", "backup"},
+			last:    "a",
+		},
+		{
+			name:    "consistent hash",
+			origins: []models.Origin{{URL: "a"}, {URL: "b"}, {URL: "c"}},
+			method:  "consistent_hash",
+			firsts:  []string{"", "", ""}, // the same origin every time
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origin := &models.OriginServer{SiteIdentifier: "s", Origins: tt.origins, LoadBalancing: tt.method}
+			targets, err := originTargets(origin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := &resource{siteIdentifier: "s", baseKey: "s:/a", origin: origin, targets: targets}
+
+			states := map[string]*health.State{}
+			for _, url := range tt.down {
+				key := "s https://" + url
+				states[key] = &health.State{Origin: key, Healthy: false}
+			}
+			saved := originHealth.states
+			originHealth.states = states
+			defer func() { originHealth.states = saved }()
+
+			b := &originBalancer{next: map[string]uint64{}, active: map[string]int{}}
+			var first string
+			for i, want := range tt.firsts {
+				order := b.order(res)
+				if len(order) != len(targets) {
+					t.Fatalf("order has %d origins, want %d", len(order), len(targets))
+				}
+				got := order[0].baseURL
+				if want == "" {
+					if i > 0 && got != first {
+						t.Errorf("request %d went to %s, earlier ones to %s", i, got, first)
+					}
+					first = got
+				} else if got != "https://"+want {
+					t.Errorf("request %d went to %s first, want %s", i, got, want)
+				}
+				if tt.last != "" && order[len(order)-1].baseURL != "https://"+tt.last {
+					t.Errorf("request %d tries %s last, want %s", i, order[len(order)-1].baseURL, tt.last)
+				}
+			}
+		})
+	}
+}
+
+func TestOriginFailed(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{200, false},
+		{404, false},
+		{500, false},
+		{501, false},
+		{502, true},
+		{503, true},
+		{504, true},
+		{505, false},
+	}
+	for _, tt := range tests {
+		if got := originFailed(tt.status); got != tt.want {
+			t.Errorf("originFailed(%d) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/zhitoo/cdn/models"
+)
+
+// siteInvalidationChannel is the Redis channel re-registered sites are announced on
+const siteInvalidationChannel = "site_invalidate"
+
+// originServerCacheTTL bounds how long a process uses the settings of a site
+// without asking the database, for processes that do not hear about
+// registrations through Redis.
+const originServerCacheTTL = 30 * time.Second
+
+// originServerCache keeps the origin servers of sites in process, so serving a
+// cached resource needs no database query.
+type originServerCache struct {
+	mu      sync.RWMutex
+	entries map[string]originServerEntry
+	rdb     *redis.Client // set once registrations are shared through Redis
+}
+
+type originServerEntry struct {
+	origin   *models.OriginServer
+	loadedAt time.Time
+}
+
+var originServers = &originServerCache{entries: map[string]originServerEntry{}}
+
+// get returns the origin server of a site, loading it with load when it is not
+// cached or was loaded too long ago. Unknown sites are not cached, so they can
+// be registered at any time.
+func (c *originServerCache) get(siteIdentifier string, load func() *models.OriginServer) *models.OriginServer {
+	c.mu.RLock()
+	entry, ok := c.entries[siteIdentifier]
+	c.mu.RUnlock()
+	if ok && time.Since(entry.loadedAt) < originServerCacheTTL {
+		return entry.origin
+	}
+
+	origin := load()
+	if origin.ID != 0 {
+		c.mu.Lock()
+		c.entries[siteIdentifier] = originServerEntry{origin: origin, loadedAt: time.Now()}
+		c.mu.Unlock()
+	}
+	return origin
+}
+
+// invalidate drops a site from the cache of this process and, with Redis, of
+// every other one.
+func (c *originServerCache) invalidate(siteIdentifier string) {
+	c.remove(siteIdentifier)
+	c.mu.RLock()
+	rdb := c.rdb
+	c.mu.RUnlock()
+	if rdb == nil {
+		return
+	}
+	if err := rdb.Publish(context.Background(), siteInvalidationChannel, siteIdentifier).Err(); err != nil {
+		log.Printf("Error publishing site invalidation: %v", err)
+	}
+}
+
+func (c *originServerCache) remove(siteIdentifier string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, siteIdentifier)
+}
+
+// WatchOriginServers shares registrations between processes through Redis, so
+// every node and prefork child drops the settings of a re-registered site at once.
+func WatchOriginServers(rdb *redis.Client) {
+	originServers.mu.Lock()
+	originServers.rdb = rdb
+	originServers.mu.Unlock()
+
+	pubsub := rdb.Subscribe(context.Background(), siteInvalidationChannel)
+	go func() {
+		for msg := range pubsub.Channel() {
+			originServers.remove(msg.Payload)
+		}
+	}()
+}
+
+// originServer returns the origin server of a site, ID 0 when it is not registered.
+func (s *APIServer) originServer(siteIdentifier string) *models.OriginServer {
+	return originServers.get(siteIdentifier, func() *models.OriginServer {
+		origin, _ := s.storage.GetOriginServerBySiteIdentifier(siteIdentifier)
+		return origin
+	})
+}
@@ -1,8 +1,6 @@
 package api
 
 import (
-	"os"
-
 	"github.com/gofiber/fiber/v2"
 	"github.com/zhitoo/cdn/models"
 	"github.com/zhitoo/cdn/requests"
@@ -14,6 +12,22 @@ func (s *APIServer) registerOriginServer(c *fiber.Ctx) error {
 	if err := c.BodyParser(payload); err != nil {
 		return err
 	}
+	origin, _ := s.storage.GetOriginServerBySiteIdentifier(payload.SiteIdentifier)
+	if origin.ID != 0 {
+		// Settings missing from the request keep their registered value
+		payload = registrationOf(origin)
+		pool := payload.Origins
+		// A pool in the request replaces the registered one rather than being
+		// merged into it
+		payload.Origins = nil
+		if err := c.BodyParser(payload); err != nil {
+			return err
+		}
+		if payload.Origins == nil {
+			payload.Origins = pool
+		}
+	}
+
 	// Validation
 	errs := s.validator.Validate(payload)
 	if errs != nil {
@@ -21,28 +35,156 @@ func (s *APIServer) registerOriginServer(c *fiber.Ctx) error {
 	}
 
 	// Authenticate the request using APIKey
-	expectedAPIKey := os.Getenv("API_KEY")
-	if payload.APIKey != expectedAPIKey {
+	if !validAPIKey(payload.APIKey) {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "Unauthorized",
 		})
 	}
 
-	origin, _ := s.storage.GetOriginServerBySiteIdentifier(payload.SiteIdentifier)
-
 	if origin.ID == 0 {
 		//must register it
 		origin = &models.OriginServer{
-			SiteIdentifier: payload.SiteIdentifier,
-			OriginURL:      payload.OriginURL,
+			SiteIdentifier:  payload.SiteIdentifier,
+			OriginURL:       payload.OriginURL,
+			Origins:         newOrigins(payload.Origins),
+			LoadBalancing:   payload.LoadBalancing,
+			OriginScheme:    payload.OriginScheme,
+			OriginPort:      payload.OriginPort,
+			OriginBasePath:  payload.OriginBasePath,
+			OriginHost:      payload.OriginHost,
+			DefaultCacheTTL: payload.DefaultCacheTTL,
+			SliceSize:       payload.SliceSize,
+
+			OriginConnectTimeout:    payload.OriginConnectTimeout,
+			OriginReadTimeout:       payload.OriginReadTimeout,
+			OriginRetries:           payload.OriginRetries,
+			CircuitBreakerThreshold: payload.CircuitBreakerThreshold,
+			CircuitBreakerCooldown:  payload.CircuitBreakerCooldown,
+
+			NegativeCacheTTL: payload.NegativeCacheTTL,
+			ErrorCacheTTL:    payload.ErrorCacheTTL,
+
+			CacheKeyQueryParams:   payload.CacheKeyQueryParams,
+			CacheKeyExcludeParams: payload.CacheKeyExcludeParams,
+			CacheKeySortParams:    payload.CacheKeySortParams,
+			CacheKeyHeaders:       payload.CacheKeyHeaders,
+			CacheKeyCookies:       payload.CacheKeyCookies,
+			CacheKeyIgnoreCase:    payload.CacheKeyIgnoreCase,
+
+			ForwardQueryParams: payload.ForwardQueryParams,
+			ForwardHeaders:     payload.ForwardHeaders,
 		}
 		_, err := s.storage.CreateOriginServer(origin)
 		if err != nil {
 			return err
 		}
+	} else {
+		//already registered, refresh its settings
+		origin.OriginURL = payload.OriginURL
+		origin.Origins = newOrigins(payload.Origins)
+		origin.LoadBalancing = payload.LoadBalancing
+		origin.OriginScheme = payload.OriginScheme
+		origin.OriginPort = payload.OriginPort
+		origin.OriginBasePath = payload.OriginBasePath
+		origin.OriginHost = payload.OriginHost
+		origin.OriginConnectTimeout = payload.OriginConnectTimeout
+		origin.OriginReadTimeout = payload.OriginReadTimeout
+		origin.OriginRetries = payload.OriginRetries
+		origin.CircuitBreakerThreshold = payload.CircuitBreakerThreshold
+		origin.CircuitBreakerCooldown = payload.CircuitBreakerCooldown
+		origin.DefaultCacheTTL = payload.DefaultCacheTTL
+		origin.SliceSize = payload.SliceSize
+		origin.NegativeCacheTTL = payload.NegativeCacheTTL
+		origin.ErrorCacheTTL = payload.ErrorCacheTTL
+		origin.CacheKeyQueryParams = payload.CacheKeyQueryParams
+		origin.CacheKeyExcludeParams = payload.CacheKeyExcludeParams
+		origin.CacheKeySortParams = payload.CacheKeySortParams
+		origin.CacheKeyHeaders = payload.CacheKeyHeaders
+		origin.CacheKeyCookies = payload.CacheKeyCookies
+		origin.CacheKeyIgnoreCase = payload.CacheKeyIgnoreCase
+		origin.ForwardQueryParams = payload.ForwardQueryParams
+		origin.ForwardHeaders = payload.ForwardHeaders
+		_, err := s.storage.UpdateOriginServer(origin)
+		if err != nil {
+			return err
+		}
 	}
+	originServers.invalidate(origin.SiteIdentifier)
 
 	return c.JSON(fiber.Map{
 		"message": "Origin server registered successfully",
 	})
 }
+
+// newOrigins converts the origin pool of a registration request.
+func newOrigins(payload []requests.OriginRequest) []models.Origin {
+	var origins []models.Origin
+	for _, o := range payload {
+		weight := o.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		origins = append(origins, models.Origin{
+			URL:      o.URL,
+			Weight:   weight,
+			Priority: o.Priority,
+
+			HealthCheckPath:     o.HealthCheckPath,
+			HealthCheckInterval: o.HealthCheckInterval,
+			HealthCheckStatus:   o.HealthCheckStatus,
+			HealthyThreshold:    o.HealthyThreshold,
+			UnhealthyThreshold:  o.UnhealthyThreshold,
+		})
+	}
+	return origins
+}
+
+// registrationOf returns the registration request of the current settings of a
+// site, without its API key.
+func registrationOf(origin *models.OriginServer) *requests.RegisterOriginServerRequest {
+	var pool []requests.OriginRequest
+	for _, o := range origin.Origins {
+		pool = append(pool, requests.OriginRequest{
+			URL:      o.URL,
+			Weight:   o.Weight,
+			Priority: o.Priority,
+
+			HealthCheckPath:     o.HealthCheckPath,
+			HealthCheckInterval: o.HealthCheckInterval,
+			HealthCheckStatus:   o.HealthCheckStatus,
+			HealthyThreshold:    o.HealthyThreshold,
+			UnhealthyThreshold:  o.UnhealthyThreshold,
+		})
+	}
+	return &requests.RegisterOriginServerRequest{
+		SiteIdentifier: origin.SiteIdentifier,
+		OriginURL:      origin.OriginURL,
+		Origins:        pool,
+		LoadBalancing:  origin.LoadBalancing,
+		OriginScheme:   origin.OriginScheme,
+		OriginPort:     origin.OriginPort,
+		OriginBasePath: origin.OriginBasePath,
+		OriginHost:     origin.OriginHost,
+
+		OriginConnectTimeout:    origin.OriginConnectTimeout,
+		OriginReadTimeout:       origin.OriginReadTimeout,
+		OriginRetries:           origin.OriginRetries,
+		CircuitBreakerThreshold: origin.CircuitBreakerThreshold,
+		CircuitBreakerCooldown:  origin.CircuitBreakerCooldown,
+
+		DefaultCacheTTL:  origin.DefaultCacheTTL,
+		SliceSize:        origin.SliceSize,
+		NegativeCacheTTL: origin.NegativeCacheTTL,
+		ErrorCacheTTL:    origin.ErrorCacheTTL,
+
+		CacheKeyQueryParams:   origin.CacheKeyQueryParams,
+		CacheKeyExcludeParams: origin.CacheKeyExcludeParams,
+		CacheKeySortParams:    origin.CacheKeySortParams,
+		CacheKeyHeaders:       origin.CacheKeyHeaders,
+		CacheKeyCookies:       origin.CacheKeyCookies,
+		CacheKeyIgnoreCase:    origin.CacheKeyIgnoreCase,
+
+		ForwardQueryParams: origin.ForwardQueryParams,
+		ForwardHeaders:     origin.ForwardHeaders,
+	}
+}
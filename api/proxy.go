@@ -0,0 +1,93 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zhitoo/cdn/cache"
+)
+
+// errOriginTimeout means the origin did not answer in time. It is an
+// errOriginUnavailable, so stale copies are served in its place as well.
+var errOriginTimeout = fmt.Errorf("%w: timed out", errOriginUnavailable)
+
+// originError classifies an error of a request to an origin as a timeout or a
+// connection failure.
+func originError(err error) error {
+	if errors.Is(err, errOriginUnavailable) {
+		return err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errOriginTimeout
+	}
+	return errOriginUnavailable
+}
+
+// rewriteLocation points the Location header of an origin redirect into the
+// CDN namespace of the site when it redirects to the origin itself, so clients
+// keep going through the CDN. Redirects to other hosts are left alone. base is
+// the URL the redirect answered.
+func rewriteLocation(header http.Header, res *resource, base *url.URL) {
+	location := header.Get("Location")
+	if location == "" {
+		return
+	}
+	target, err := base.Parse(location)
+	if err != nil {
+		return
+	}
+	if !isOriginHost(res, target.Host) {
+		return
+	}
+
+	// The origin URL may have a path of its own in front of the resource path
+	basePath := strings.TrimSuffix(base.Path, res.path)
+	path, ok := strings.CutPrefix(target.Path, basePath)
+	if !ok || (path != "" && !strings.HasPrefix(path, "/")) {
+		// Outside of the site, send the client to the origin
+		header.Set("Location", target.String())
+		return
+	}
+	rewritten := &url.URL{Path: "/" + res.siteIdentifier + path, RawQuery: target.RawQuery, Fragment: target.Fragment}
+	header.Set("Location", rewritten.String())
+}
+
+// isOriginHost reports whether host is one of the origins of the resource's site.
+func isOriginHost(res *resource, host string) bool {
+	// Origins behind a Host override redirect to that host
+	if res.origin.OriginHost != "" && strings.EqualFold(host, res.origin.OriginHost) {
+		return true
+	}
+	for _, target := range res.targets {
+		if u, err := url.Parse(target.baseURL); err == nil && strings.EqualFold(host, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyResponse passes an origin response on to the client as it is, without
+// caching it, with redirects to the origin rewritten.
+func proxyResponse(c *fiber.Ctx, res *resource, resp *http.Response) error {
+	meta := &cache.Meta{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		StatusCode:   resp.StatusCode,
+		Header:       storedHeaders(resp.Header),
+	}
+	rewriteLocation(meta.Header, res, resp.Request.URL)
+
+	replayHeaders(c, meta)
+	setCacheStatus(c, res, &cachedEntry{meta: meta, cacheStatus: cacheBypass})
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		c.Set("Content-Type", contentType)
+	}
+	c.Status(resp.StatusCode)
+	return c.SendStream(resp.Body, int(resp.ContentLength))
+}
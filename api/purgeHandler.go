@@ -0,0 +1,247 @@
+package api
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zhitoo/cdn/cache"
+	"github.com/zhitoo/cdn/requests"
+)
+
+// purgeCache handles POST /purge. It removes a single path including all of its
+// width/height variants, everything under a path prefix, or a whole site.
+func (s *APIServer) purgeCache(c *fiber.Ctx) error {
+	payload := new(requests.PurgeRequest)
+
+	if err := c.BodyParser(payload); err != nil {
+		return err
+	}
+	// Validation
+	errs := s.validator.Validate(payload)
+	if errs != nil {
+		return c.Status(422).JSON(errs)
+	}
+
+	if !validAPIKey(payload.APIKey) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	var purged int
+	var err error
+	switch {
+	case payload.Path != "":
+		purged, err = purgePath(s.store, payload.SiteIdentifier, s.keyPath(payload.SiteIdentifier, filepath.Clean(payload.Path)), payload.Soft)
+	case payload.Prefix != "":
+		purged, err = purgePrefix(s.store, payload.SiteIdentifier, s.keyPath(payload.SiteIdentifier, payload.Prefix), payload.Soft)
+	default:
+		purged, err = purgeSite(s.store, payload.SiteIdentifier, payload.Soft)
+	}
+	if err != nil {
+		log.Printf("Error purging cache: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(ApiError{Message: "purge failed"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Cache purged successfully",
+		"purged":  purged,
+	})
+}
+
+// purgeCacheTags handles POST /purge/tags. It removes every entry of a site whose
+// origin response carried one of the given Surrogate-Key/Cache-Tag values.
+func (s *APIServer) purgeCacheTags(c *fiber.Ctx) error {
+	payload := new(requests.PurgeTagsRequest)
+
+	if err := c.BodyParser(payload); err != nil {
+		return err
+	}
+	// Validation
+	errs := s.validator.Validate(payload)
+	if errs != nil {
+		return c.Status(422).JSON(errs)
+	}
+
+	if !validAPIKey(payload.APIKey) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	tags := strings.FieldsFunc(payload.Tags, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	purged, err := purgeTags(s.store, payload.SiteIdentifier, tags, payload.Soft)
+	if err != nil {
+		log.Printf("Error purging cache tags: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(ApiError{Message: "purge failed"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Cache purged successfully",
+		"purged":  purged,
+	})
+}
+
+// purgeRequest handles the HTTP PURGE method on a CDN URL, authenticated with the
+// X-API-Key header. A path ending in "*" purges everything under that prefix, and
+// a "Soft-Purge: 1" header marks entries stale instead of deleting them.
+func (s *APIServer) purgeRequest(c *fiber.Ctx) error {
+	if !validAPIKey(c.Get("X-API-Key")) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	// Split the path to extract the site identifier and resource path
+	segments := strings.SplitN(c.Path(), "/", 3) // ["", "siteIdentifier", "resourcePath"]
+	if len(segments) < 3 || segments[1] == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid URL format")
+	}
+	siteIdentifier := segments[1]
+	resourcePath := "/" + segments[2]
+	soft := c.Get("Soft-Purge") == "1"
+
+	var purged int
+	var err error
+	if prefix, ok := strings.CutSuffix(resourcePath, "*"); ok {
+		if prefix == "/" {
+			purged, err = purgeSite(s.store, siteIdentifier, soft)
+		} else {
+			purged, err = purgePrefix(s.store, siteIdentifier, s.keyPath(siteIdentifier, prefix), soft)
+		}
+	} else {
+		purged, err = purgePath(s.store, siteIdentifier, s.keyPath(siteIdentifier, filepath.Clean(resourcePath)), soft)
+	}
+	if err != nil {
+		log.Printf("Error purging cache: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(ApiError{Message: "purge failed"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Cache purged successfully",
+		"purged":  purged,
+	})
+}
+
+// keyPath returns a path as it appears in the cache keys of a site, lower case
+// when its cache key policy ignores case.
+func (s *APIServer) keyPath(siteIdentifier, path string) string {
+	origin := s.originServer(siteIdentifier)
+	if origin.CacheKeyIgnoreCase {
+		return strings.ToLower(path)
+	}
+	return path
+}
+
+// purgePath removes siteIdentifier:resourcePath and all of its variants: query
+// parameters (including width/height), header and cookie variants from the cache
+// key policy, Vary variants and slices.
+func purgePath(store cache.CacheStore, siteIdentifier, resourcePath string, soft bool) (int, error) {
+	cacheKey := siteIdentifier + ":" + resourcePath
+	purged, err := purgeMatching(store, cacheKey+"?", soft)
+	if err != nil {
+		return purged, err
+	}
+	variants, err := purgeMatching(store, cacheKey+"#", soft)
+	purged += variants
+	if err != nil {
+		return purged, err
+	}
+	deleted, err := purgeEntry(store, cacheKey, soft)
+	if deleted {
+		purged++
+	}
+	return purged, err
+}
+
+// purgePrefix removes every entry of a site whose path starts with prefix.
+func purgePrefix(store cache.CacheStore, siteIdentifier, prefix string, soft bool) (int, error) {
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return purgeMatching(store, siteIdentifier+":"+prefix, soft)
+}
+
+// purgeSite removes every entry of a site.
+func purgeSite(store cache.CacheStore, siteIdentifier string, soft bool) (int, error) {
+	// Resource paths always start with "/"
+	return purgeMatching(store, siteIdentifier+":/", soft)
+}
+
+// purgeMatching removes every cache key starting with prefix.
+func purgeMatching(store cache.CacheStore, prefix string, soft bool) (int, error) {
+	purged := 0
+	err := store.Iterate(prefix, func(cacheKey string, _ *cache.Meta) error {
+		deleted, err := purgeEntry(store, cacheKey, soft)
+		if deleted {
+			purged++
+		}
+		return err
+	})
+	return purged, err
+}
+
+// purgeTags removes every entry of a site carrying one of the given tags.
+func purgeTags(store cache.CacheStore, siteIdentifier string, tags []string, soft bool) (int, error) {
+	purged := 0
+	for _, tag := range tags {
+		cacheKeys, err := store.TaggedKeys(siteIdentifier, tag)
+		if err != nil {
+			return purged, err
+		}
+		for _, cacheKey := range cacheKeys {
+			deleted, err := purgeEntry(store, cacheKey, soft)
+			if err != nil {
+				return purged, err
+			}
+			if deleted {
+				purged++
+			}
+		}
+	}
+	return purged, nil
+}
+
+// purgeEntry hard or soft purges a single cache key.
+func purgeEntry(store cache.CacheStore, cacheKey string, soft bool) (bool, error) {
+	if soft {
+		return softPurgeCacheKey(store, cacheKey)
+	}
+	return store.Delete(cacheKey)
+}
+
+// softPurgeCacheKey marks an entry as stale instead of deleting it. The next
+// request revalidates it with the origin, and until then it can still be served
+// when the origin fails. Entries that cannot be revalidated or served stale are
+// removed. Vary indexes are left alone, the variants they lead to are purged on
+// their own.
+func softPurgeCacheKey(store cache.CacheStore, cacheKey string) (bool, error) {
+	meta, err := store.Stat(cacheKey)
+	if err != nil {
+		return false, err
+	}
+	// Missing entries are not purged, entries without metadata are removed
+	if meta == nil {
+		return store.Delete(cacheKey)
+	}
+	if len(meta.Vary) > 0 {
+		return false, nil
+	}
+	meta.SoftPurged = true
+	meta.ExpiresAt = time.Now().Unix()
+	retention := meta.Retention(0)
+	if retention <= 0 {
+		return store.Delete(cacheKey)
+	}
+
+	// Soft purged entries stay tagged until they are really gone
+	if err := store.SetMeta(cacheKey, meta, retention); err != nil {
+		return false, err
+	}
+	return true, nil
+}
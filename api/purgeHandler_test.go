@@ -0,0 +1,53 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zhitoo/cdn/cache"
+)
+
+func TestSoftPurgeCacheKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		meta   *cache.Meta // nil for no entry
+		purged bool
+		kept   bool // whether the entry is still stored, soft purged
+	}{
+		{"missing", nil, false, false},
+		{"revalidatable", &cache.Meta{ETag: `"1"`}, true, true},
+		{"servable stale", &cache.Meta{StaleIfError: 60}, true, true},
+		{"neither", &cache.Meta{}, true, false},
+		{"vary index", &cache.Meta{Vary: []string{"Accept-Encoding"}}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := cache.BaseDir
+			cache.BaseDir = t.TempDir()
+			defer func() { cache.BaseDir = saved }()
+
+			store := cache.NewMemoryStore(0)
+			if tt.meta != nil {
+				tt.meta.ExpiresAt = time.Now().Add(time.Hour).Unix()
+				store.Set("s:/a", &cache.Entry{Content: []byte("a"), Meta: tt.meta}, time.Hour)
+			}
+			purged, err := softPurgeCacheKey(store, "s:/a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if purged != tt.purged {
+				t.Errorf("purged = %v, want %v", purged, tt.purged)
+			}
+			meta, _ := store.Stat("s:/a")
+			if (meta != nil) != tt.kept {
+				t.Fatalf("kept = %v, want %v", meta != nil, tt.kept)
+			}
+			if meta != nil && tt.purged && (!meta.SoftPurged || meta.IsFresh()) {
+				t.Errorf("entry not marked soft purged: %+v", meta)
+			}
+			if meta != nil && !tt.purged && (meta.SoftPurged || !meta.IsFresh()) {
+				t.Errorf("entry changed: %+v", meta)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zhitoo/cdn/cache"
+)
+
+// maxRanges caps the number of ranges served in one multipart response
+const maxRanges = 16
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// byteRange is a range of bytes of a cached body.
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header for a body of size bytes. It returns nil
+// ranges when the header is malformed and has to be ignored, and
+// errRangeNotSatisfiable when no range overlaps the body.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+	// An empty body has no bytes to select, not even a suffix
+	if size == 0 {
+		return nil, errRangeNotSatisfiable
+	}
+
+	var ranges []byteRange
+	var total int64
+	noOverlap := false
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		startStr, endStr, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, nil
+		}
+		startStr, endStr = strings.TrimSpace(startStr), strings.TrimSpace(endStr)
+
+		var r byteRange
+		if startStr == "" {
+			// Suffix range: the last n bytes
+			n, err := strconv.ParseInt(endStr, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 {
+				noOverlap = true
+				continue
+			}
+			n = min(n, size)
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(startStr, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			if start >= size {
+				noOverlap = true
+				continue
+			}
+			end := size - 1
+			if endStr != "" {
+				end, err = strconv.ParseInt(endStr, 10, 64)
+				if err != nil || end < start {
+					return nil, nil
+				}
+				end = min(end, size-1)
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+		total += r.length
+	}
+
+	if len(ranges) == 0 {
+		if noOverlap {
+			return nil, errRangeNotSatisfiable
+		}
+		return nil, nil
+	}
+	// Serve the whole body for abusive or pointless range sets
+	if len(ranges) > maxRanges || total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches evaluates an If-Range header against the entry's validators.
+// Ranges are only served when the client's copy is still current.
+func ifRangeMatches(ifRange string, meta *cache.Meta) bool {
+	if ifRange == "" {
+		return true
+	}
+	if meta == nil {
+		return false
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		// Strong comparison, weak validators never match
+		return !strings.HasPrefix(ifRange, "W/") && !strings.HasPrefix(meta.ETag, "W/") && ifRange == meta.ETag
+	}
+	if meta.LastModified == "" {
+		return false
+	}
+	since, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(meta.LastModified)
+	return err == nil && lastModified.Equal(since)
+}
+
+// readerAtCloser is a cached body opened for random access.
+type readerAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+type bytesBody struct {
+	*bytes.Reader
+}
+
+func (bytesBody) Close() error {
+	return nil
+}
+
+// open opens the cached body for random access and returns it with its size.
+func (e *cachedEntry) open() (readerAtCloser, int64, error) {
+	if e.filePath == "" {
+		return bytesBody{bytes.NewReader(e.content)}, int64(len(e.content)), nil
+	}
+	file, err := os.Open(e.filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// sectionReadCloser streams one range of a body and closes the body afterwards.
+type sectionReadCloser struct {
+	*io.SectionReader
+	io.Closer
+}
+
+// serveRanges answers a Range request from a cached entry. It returns false when
+// the request has to be answered with the whole body instead.
+func serveRanges(c *fiber.Ctx, entry *cachedEntry, path string) (bool, error) {
+	body, size, err := entry.open()
+	if err != nil {
+		log.Printf("Error opening cached entry: %v", err)
+		return false, nil
+	}
+
+	// Determine the content type from the path or the first bytes
+	sniff := make([]byte, 512)
+	n, _ := body.ReadAt(sniff, 0)
+	contentType := entryContentType(entry, path, sniff[:n])
+
+	return serveBodyRanges(c, body, size, contentType)
+}
+
+// serveBodyRanges answers a Range request from a body of size bytes, which it
+// takes ownership of. It returns false when the request has to be answered with
+// the whole body instead; the body is closed in that case.
+func serveBodyRanges(c *fiber.Ctx, body readerAtCloser, size int64, contentType string) (bool, error) {
+	ranges, err := parseRange(c.Get("Range"), size)
+	if errors.Is(err, errRangeNotSatisfiable) {
+		body.Close()
+		c.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return true, c.SendStatus(fiber.StatusRequestedRangeNotSatisfiable)
+	}
+	if ranges == nil {
+		body.Close()
+		return false, nil
+	}
+
+	c.Status(fiber.StatusPartialContent)
+	if len(ranges) == 1 {
+		r := ranges[0]
+		c.Set("Content-Type", contentType)
+		c.Set("Content-Range", r.contentRange(size))
+		return true, c.SendStream(sectionReadCloser{io.NewSectionReader(body, r.start, r.length), body}, int(r.length))
+	}
+
+	// Several ranges are sent as multipart/byteranges
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	c.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	go func() {
+		defer body.Close()
+		for _, r := range ranges {
+			part, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":  {contentType},
+				"Content-Range": {r.contentRange(size)},
+			})
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(part, io.NewSectionReader(body, r.start, r.length)); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+	return true, c.SendStream(pr)
+}
+
+// proxyRange answers a Range request on a cache miss straight from the origin,
+// while the full object is cached by a separate request.
+func proxyRange(c *fiber.Ctx, res *resource) error {
+	resp, err := fetchFromOrigin(res, http.MethodGet, func(req *http.Request) {
+		req.Header.Set("Range", c.Get("Range"))
+		if ifRange := c.Get("If-Range"); ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+	})
+	if err != nil {
+		return sendFetchError(c, err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+	default:
+		log.Printf("Origin responded to range request with status %d", resp.StatusCode)
+		return proxyResponse(c, res, resp)
+	}
+
+	c.Status(resp.StatusCode)
+	setCacheStatus(c, res, &cachedEntry{cacheStatus: cacheMiss})
+	for _, header := range []string{"Content-Type", "Content-Range", "ETag", "Last-Modified"} {
+		if value := resp.Header.Get(header); value != "" {
+			c.Set(header, value)
+		}
+	}
+	c.Set("Accept-Ranges", "bytes")
+	return c.SendStream(resp.Body, int(resp.ContentLength))
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/zhitoo/cdn/cache"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		size   int64
+		ranges []byteRange
+		err    error
+	}{
+		{"first bytes", "bytes=0-9", 100, []byteRange{{0, 10}}, nil},
+		{"open ended", "bytes=90-", 100, []byteRange{{90, 10}}, nil},
+		{"end past the body", "bytes=90-200", 100, []byteRange{{90, 10}}, nil},
+		{"suffix", "bytes=-5", 100, []byteRange{{95, 5}}, nil},
+		{"suffix longer than the body", "bytes=-500", 100, []byteRange{{0, 100}}, nil},
+		{"several", "bytes=0-0, 50-59", 100, []byteRange{{0, 1}, {50, 10}}, nil},
+		{"one overlapping", "bytes=200-300, 0-4", 100, []byteRange{{0, 5}}, nil},
+		{"start past the body", "bytes=100-", 100, nil, errRangeNotSatisfiable},
+		{"empty suffix", "bytes=-0", 100, nil, errRangeNotSatisfiable},
+		{"empty body", "bytes=-5", 0, nil, errRangeNotSatisfiable},
+		{"other unit", "items=0-9", 100, nil, nil},
+		{"malformed", "bytes=abc", 100, nil, nil},
+		{"end before start", "bytes=9-0", 100, nil, nil},
+		{"more than the body", "bytes=0-99, 0-99", 100, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, err := parseRange(tt.header, tt.size)
+			if !errors.Is(err, tt.err) || !reflect.DeepEqual(ranges, tt.ranges) {
+				t.Errorf("got (%v, %v), want (%v, %v)", ranges, err, tt.ranges, tt.err)
+			}
+		})
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	meta := &cache.Meta{ETag: `"abc"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}
+	tests := []struct {
+		name    string
+		ifRange string
+		meta    *cache.Meta
+		want    bool
+	}{
+		{"no header", "", meta, true},
+		{"same etag", `"abc"`, meta, true},
+		{"other etag", `"def"`, meta, false},
+		{"weak etag", `W/"abc"`, meta, false},
+		{"weak stored etag", `"abc"`, &cache.Meta{ETag: `W/"abc"`}, false},
+		{"same date", "Mon, 02 Jan 2006 15:04:05 GMT", meta, true},
+		{"other date", "Mon, 02 Jan 2006 15:04:06 GMT", meta, false},
+		{"no last-modified", "Mon, 02 Jan 2006 15:04:05 GMT", &cache.Meta{}, false},
+		{"no entry", `"abc"`, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ifRangeMatches(tt.ifRange, tt.meta); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/zhitoo/cdn/models"
+)
+
+var (
+	errInvalidURL          = errors.New("invalid URL format")
+	errOriginNotConfigured = errors.New("origin server not configured")
+	errInvalidOriginURL    = errors.New("invalid origin URL")
+)
+
+// resource is a CDN resource requested as /siteIdentifier/resourcePath?width=&height=.
+type resource struct {
+	siteIdentifier string
+	path           string // resource path below the site identifier
+	cacheKey       string
+	widthStr       string
+	heightStr      string
+
+	// baseKey is the cache key before a variant is selected, cacheKey becomes the
+	// key of the variant matching header when the origin varies its responses
+	baseKey string
+	header  http.Header
+	vary    []string
+
+	// forwardHeaders are the request headers the site passes on to the origin
+	forwardHeaders []string
+
+	// Set by resolveOrigin
+	origin  *models.OriginServer
+	targets []originTarget
+	// originQuery is the part of the query string forwarded to the origin
+	originQuery string
+}
+
+// newResource splits a CDN path into site identifier and resource path and
+// derives the cache key from them and the query parameters.
+func newResource(path string, query url.Values) (*resource, error) {
+	path = filepath.Clean("/" + path)
+
+	// Split the path to extract the site identifier and resource path
+	segments := strings.SplitN(path, "/", 3) // ["", "siteIdentifier", "resourcePath"]
+	if len(segments) < 3 {
+		return nil, errInvalidURL
+	}
+	res := &resource{
+		siteIdentifier: segments[1],
+		path:           "/" + segments[2],
+		widthStr:       query.Get("width"),
+		heightStr:      query.Get("height"),
+	}
+
+	// Create cache key
+	res.cacheKey = res.siteIdentifier + ":" + res.path
+
+	// Include query parameters in cacheKey for resized images
+	if res.widthStr != "" || res.heightStr != "" {
+		res.cacheKey += fmt.Sprintf("?width=%s&height=%s", res.widthStr, res.heightStr)
+	}
+	res.baseKey = res.cacheKey
+	return res, nil
+}
+
+// resolveOrigin looks up the origin server of the resource's site and the pool
+// of origins the resource can be fetched from.
+func (s *APIServer) resolveOrigin(res *resource) error {
+	// Retrieve the origin server of the site, cached in process
+	origin := s.originServer(res.siteIdentifier)
+	if origin.ID == 0 {
+		return errOriginNotConfigured
+	}
+	res.origin = origin
+
+	targets, err := originTargets(origin)
+	if err != nil {
+		return err
+	}
+	res.targets = targets
+	return nil
+}
+
+// originBaseURL returns the URL the resource paths of a site are appended to,
+// built from the URL of one of its origins and the scheme, port and base path
+// overrides of the site.
+func originBaseURL(origin *models.OriginServer, raw string) (string, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" {
+		return "", errInvalidOriginURL
+	}
+	if origin.OriginScheme != "" {
+		u.Scheme = origin.OriginScheme
+	}
+	if origin.OriginPort != 0 {
+		u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(origin.OriginPort))
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + strings.TrimSuffix(origin.OriginBasePath, "/")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// targetURL is the URL of the resource on one of its origins.
+func (res *resource) targetURL(target originTarget) string {
+	if res.originQuery != "" {
+		return target.baseURL + res.path + "?" + res.originQuery
+	}
+	return target.baseURL + res.path
+}
+
+// newOriginRequest creates a request for the resource to one of its origins,
+// with the forwarded request headers and the site's Host override.
+func newOriginRequest(method string, res *resource, target originTarget) (*http.Request, error) {
+	req, err := http.NewRequest(method, res.targetURL(target), nil)
+	if err != nil {
+		return nil, err
+	}
+	forwardRequestHeaders(req, res)
+	if res.origin.OriginHost != "" {
+		req.Host = res.origin.OriginHost
+	}
+	return req, nil
+}
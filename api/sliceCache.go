@@ -0,0 +1,242 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zhitoo/cdn/cache"
+)
+
+// errSlicingUnsupported means the origin ignored a Range request, so the object
+// has to be cached as a whole.
+var errSlicingUnsupported = errors.New("origin does not support range requests")
+
+// sliceKey is the cache key of the index-th slice of an object.
+func sliceKey(cacheKey string, index int64) string {
+	return cacheKey + "#slice=" + strconv.FormatInt(index, 10)
+}
+
+// slicedObject gives random access to an object cached in fixed-size slices.
+// Slices are read from the cache or fetched from the origin on demand, so a seek
+// only fetches the slices it needs.
+type slicedObject struct {
+	store     cache.CacheStore
+	res       *resource
+	sliceSize int64
+	size      int64
+	etag      string
+	first     *cachedEntry // the first slice loaded
+
+	// The slice read last, kept open for sequential reads
+	mu      sync.Mutex
+	index   int64
+	current readerAtCloser
+}
+
+// openSlicedObject learns the size of an object by loading the slice that
+// contains offset.
+func openSlicedObject(store cache.CacheStore, res *resource, offset int64) (*slicedObject, error) {
+	obj := &slicedObject{store: store, res: res, sliceSize: res.origin.SliceSize, index: -1}
+	entry, err := obj.slice(offset / obj.sliceSize)
+	if err != nil {
+		return nil, err
+	}
+	obj.size = entry.meta.ObjectSize
+	obj.etag = entry.meta.ETag
+	obj.first = entry
+	return obj, nil
+}
+
+// slice returns the index-th slice from the cache, fetching it when needed.
+func (o *slicedObject) slice(index int64) (*cachedEntry, error) {
+	key := sliceKey(o.res.cacheKey, index)
+	for retries := 0; ; retries++ {
+		cached := getCachedEntry(o.store, key)
+		if cached != nil && cached.meta != nil && cached.isFresh() {
+			return cached, nil
+		}
+
+		// Implement locking to prevent cache stampede
+		locked, err := o.store.Lock(key, 30*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			defer o.store.Unlock(key)
+			return o.fetchSlice(key, index)
+		}
+		if retries == 50 {
+			return nil, errOriginUnavailable
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// fetchSlice fetches one slice from the origin with a Range request and caches it on disk.
+func (o *slicedObject) fetchSlice(key string, index int64) (*cachedEntry, error) {
+	start := index * o.sliceSize
+	resp, err := fetchFromOrigin(o.res, http.MethodGet, func(req *http.Request) {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+o.sliceSize-1))
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil, errSlicingUnsupported
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		return nil, errRangeNotSatisfiable
+	case resp.StatusCode >= http.StatusInternalServerError:
+		log.Printf("Error fetching slice from origin: status %d", resp.StatusCode)
+		return nil, errOriginUnavailable
+	case resp.StatusCode != http.StatusPartialContent:
+		// Redirects and errors are passed on by fetching the whole object
+		return nil, errSlicingUnsupported
+	}
+
+	// Content-Range: bytes start-end/size
+	_, sizeStr, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil {
+		return nil, errSlicingUnsupported
+	}
+
+	meta, retention, cacheable := newCacheMeta(resp.Header, o.res.origin)
+	meta.ObjectSize = size
+	if o.etag != "" && meta.ETag != o.etag {
+		// The object changed while it was being sliced, start over
+		log.Printf("Object %s changed on the origin, purging its slices", o.res.cacheKey)
+		purgeMatching(o.store, o.res.cacheKey+"#slice=", false)
+		return nil, errOriginUnavailable
+	}
+	if !cacheable {
+		return nil, errSlicingUnsupported
+	}
+
+	filler, err := newCacheFillReader(key, resp.Body, resp.ContentLength, io.NopCloser(nil), func(filePath string, size int64, contentHash string) {
+		meta.Size, meta.ContentHash = size, contentHash
+		storeFileEntry(o.store, key, filePath, meta, retention)
+	})
+	if err != nil {
+		return nil, err
+	}
+	filePath, err := filler.fill()
+	if err != nil {
+		return nil, err
+	}
+	return &cachedEntry{filePath: filePath, meta: meta, cacheStatus: cacheMiss}, nil
+}
+
+func (o *slicedObject) ReadAt(p []byte, off int64) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	read := 0
+	for read < len(p) {
+		if off >= o.size {
+			return read, io.EOF
+		}
+		index := off / o.sliceSize
+		if index != o.index {
+			entry, err := o.slice(index)
+			if err != nil {
+				return read, err
+			}
+			body, _, err := entry.open()
+			if err != nil {
+				return read, err
+			}
+			if o.current != nil {
+				o.current.Close()
+			}
+			o.index, o.current = index, body
+		}
+
+		n, err := o.current.ReadAt(p[read:], off-index*o.sliceSize)
+		read += n
+		off += int64(n)
+		if err != nil && err != io.EOF {
+			return read, err
+		}
+		if n == 0 {
+			// The slice is shorter than expected
+			return read, io.ErrUnexpectedEOF
+		}
+	}
+	return read, nil
+}
+
+func (o *slicedObject) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.current != nil {
+		o.current.Close()
+		o.current = nil
+	}
+	return nil
+}
+
+// serveSliced serves a resource of a site with slice caching enabled. It returns
+// false when the origin does not support ranges and the object has to be
+// fetched as a whole.
+func serveSliced(c *fiber.Ctx, store cache.CacheStore, res *resource) (bool, error) {
+	// Load the slice the requested range starts in, which also tells the size
+	var offset int64
+	if spec, ok := strings.CutPrefix(c.Get("Range"), "bytes="); ok {
+		startStr, _, _ := strings.Cut(spec, "-")
+		offset, _ = strconv.ParseInt(strings.TrimSpace(startStr), 10, 64)
+	}
+	obj, err := openSlicedObject(store, res, offset)
+	if errors.Is(err, errRangeNotSatisfiable) && offset > 0 {
+		obj, err = openSlicedObject(store, res, 0)
+	}
+	if errors.Is(err, errSlicingUnsupported) {
+		return false, nil
+	}
+	if err != nil {
+		return true, sendFetchError(c, err)
+	}
+
+	// Use the origin's content type, or determine it from the path, sniffing only
+	// the slice already loaded
+	contentType := obj.first.meta.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(res.path))
+	}
+	if contentType == "" && offset < obj.sliceSize {
+		sniff := make([]byte, 512)
+		n, _ := obj.ReadAt(sniff, 0)
+		contentType = http.DetectContentType(sniff[:n])
+	} else if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	replayHeaders(c, obj.first.meta)
+	setCacheStatus(c, res, obj.first)
+	c.Set("Accept-Ranges", "bytes")
+	if c.Get("Range") != "" && ifRangeMatches(c.Get("If-Range"), &cache.Meta{ETag: obj.etag}) {
+		if handled, err := serveBodyRanges(c, obj, obj.size, contentType); handled {
+			return true, err
+		}
+		// serveBodyRanges closed the object, reopen it for the full response
+		obj, err = openSlicedObject(store, res, 0)
+		if err != nil {
+			return true, sendFetchError(c, err)
+		}
+	}
+
+	c.Set("Content-Type", contentType)
+	return true, c.SendStream(sectionReadCloser{io.NewSectionReader(obj, 0, obj.size), obj}, int(obj.size))
+}
@@ -1,92 +1,185 @@
 package api
 
 import (
-	"context"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
-	"fmt"
 	"io"
 	"log"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/gofiber/fiber/v2"
 	"github.com/h2non/bimg"
 	"github.com/tdewolff/minify"
 	"github.com/tdewolff/minify/css"
 	"github.com/tdewolff/minify/js"
+	"github.com/zhitoo/cdn/cache"
+	"github.com/zhitoo/cdn/models"
 )
 
-func (s *APIServer) serveStatic(c *fiber.Ctx) error {
-	rdb := s.rdb
-	ctx := context.Background()
+var (
+	// errOriginUnavailable means the origin could not be reached or answered with a 5xx
+	// where no response can be passed on
+	errOriginUnavailable = errors.New("origin unavailable")
+	errImageProcessing   = errors.New("image processing error")
+)
 
-	path := filepath.Clean(c.Path())
-	//hostname := c.Hostname()
+// originClient is used for every request to an origin server. Redirects are
+// not followed but passed on to the client.
+var originClient = &http.Client{
+	Transport: originTransport(),
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
 
-	// Split the path to extract the site identifier and resource path
-	segments := strings.SplitN(path, "/", 3) // ["", "siteIdentifier", "resourcePath"]
-	if len(segments) < 3 {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid URL format")
+// cachedEntry is a cached body together with its metadata.
+type cachedEntry struct {
+	content  []byte // set when the body is held in memory
+	filePath string // set when the body is stored on disk
+	meta     *cache.Meta
+
+	// stream is set while a large body is streamed from the origin
+	stream        io.ReadCloser
+	contentType   string
+	contentLength int64
+
+	// cacheStatus tells how the entry was obtained, tier which store it came from
+	cacheStatus string
+	tier        string
+}
+
+// getCachedEntry reads an entry and its metadata from the cache store, nil on a miss.
+func getCachedEntry(store cache.CacheStore, cacheKey string) *cachedEntry {
+	entry, err := store.Get(cacheKey)
+	if err != nil {
+		log.Printf("Error reading %s from the cache: %v", cacheKey, err)
+		return nil
 	}
-	siteIdentifier := segments[1]
-	resourcePath := "/" + segments[2]
-
-	// Create cache key
-	cacheKey := siteIdentifier + ":" + resourcePath
-
-	// Include query parameters in cacheKey for resized images
-	widthStr := c.Query("width")
-	heightStr := c.Query("height")
-	if widthStr != "" || heightStr != "" {
-		cacheKey += fmt.Sprintf("?width=%s&height=%s", widthStr, heightStr)
-	}
-
-	// Check Redis cache
-	cachedValue, err := rdb.Get(ctx, cacheKey).Result()
-	if err == nil {
-		// Determine if cachedValue is a file path or content
-		if strings.HasPrefix(cachedValue, "file:") {
-			// It's a file path
-			filePath := cachedValue[5:] // Remove "file:" prefix
-			return c.SendFile(filePath)
-		} else {
-			// It's content stored directly in Redis
-			content := []byte(cachedValue)
-			contentType := getContentType(resourcePath, content)
-			c.Set("Content-Type", contentType)
-			return c.Send(content)
+	if entry == nil {
+		return nil
+	}
+	// Files may have been evicted to keep the cache directory within its budget
+	if entry.FilePath != "" && !cache.Touch(entry.FilePath) {
+		return nil
+	}
+	return &cachedEntry{content: entry.Content, filePath: entry.FilePath, meta: entry.Meta, cacheStatus: cacheHit, tier: entry.Tier}
+}
+
+// isFresh reports whether the entry can be served without contacting the origin.
+// Entries without metadata are only bound by their retention in the store.
+func (e *cachedEntry) isFresh() bool {
+	return e.meta == nil || e.meta.IsFresh()
+}
+
+// size returns the size of the cached body in bytes.
+func (e *cachedEntry) size() int64 {
+	if e.filePath != "" {
+		info, err := os.Stat(e.filePath)
+		if err != nil {
+			return 0
 		}
+		return info.Size()
+	}
+	return int64(len(e.content))
+}
+
+func (s *APIServer) serveStatic(c *fiber.Ctx) error {
+	store := s.store
+
+	rawQuery := string(c.Request().URI().QueryString())
+	query, _ := url.ParseQuery(rawQuery)
+	res, err := newResource(c.Path(), query)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid URL format")
 	}
 
-	// Retrieve the origin server URL from the database using siteIdentifier
-	origin, _ := s.storage.GetOriginServerBySiteIdentifier(siteIdentifier)
-	if origin.ID == 0 {
+	res.header = requestHeader(c)
+
+	// The cache key depends on the site's cache key policy
+	if err := s.resolveOrigin(res); err != nil {
 		return c.Status(fiber.StatusNotFound).SendString("Origin server not configured")
 	}
+	res.applyCacheKeyPolicy(rawQuery)
+
+	// HEAD and conditional requests are answered from the metadata when possible
+	if c.Method() == fiber.MethodHead || isConditional(c) {
+		if handled, err := serveFromMeta(c, store, res); handled {
+			return err
+		}
+	}
 
-	// Construct the origin URL
-	originURL := origin.OriginURL + resourcePath
+	// Check the cache
+	cached := lookupEntry(store, res)
+	if cached != nil && cached.isFresh() {
+		return serveCachedEntry(c, cached, res)
+	}
+
+	// HEAD requests for uncached resources only need the origin headers
+	if c.Method() == fiber.MethodHead && cached == nil && !needsProcessing(getContentType(res.path, nil), res) {
+		return proxyHead(c, res)
+	}
+
+	// Very large objects are cached in fixed-size slices when the site enables it
+	if res.origin.SliceSize > 0 && !needsProcessing(getContentType(res.path, nil), res) {
+		if handled, err := serveSliced(c, store, res); handled {
+			return err
+		}
+	}
+
+	// Serve the stale copy right away and refresh it in the background
+	if cached != nil && cached.meta.CanServeStaleWhileRevalidate() {
+		go fetchInBackground(store, res, cached)
+		return serveStale(c, cached, res, `110 - "Response is Stale"`)
+	}
+
+	// Answer ranged requests for uncached objects from the origin right away
+	// and fill the cache with the full object in the background
+	if c.Get("Range") != "" && cached == nil && !needsProcessing(getContentType(res.path, nil), res) {
+		go fetchInBackground(store, res, nil)
+		return proxyRange(c, res)
+	}
 
 	// Implement locking to prevent cache stampede
-	locked, err := acquireLock(rdb, cacheKey, 30*time.Second)
+	locked, err := store.Lock(res.cacheKey, 30*time.Second)
 	if err != nil {
 		log.Printf("Error acquiring lock: %v", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
 	}
 
 	if locked {
-		defer releaseLock(rdb, cacheKey)
+		lockKey := res.cacheKey
+		unlock := true
+		defer func() {
+			if unlock {
+				store.Unlock(lockKey)
+			}
+		}()
 
 		// Fetch, process, and cache the content
-		return fetchProcessAndCacheContent(c, rdb, originURL, cacheKey, resourcePath, widthStr, heightStr)
+		entry, err := fetchProcessAndCacheContent(store, res, cached, true)
+		if err != nil {
+			// Fall back to the stale copy while the origin is failing
+			if errors.Is(err, errOriginUnavailable) && cached != nil && cached.meta.CanServeStaleIfError() {
+				return serveStale(c, cached, res, `111 - "Revalidation Failed"`)
+			}
+			return sendFetchError(c, err)
+		}
+		// A body streamed into the cache keeps the lock until it is stored, so
+		// concurrent requests wait for it instead of fetching it again
+		if filler, ok := entry.stream.(*cacheFillReader); ok {
+			unlock = false
+			filler.release = func() { store.Unlock(lockKey) }
+		}
+		return serveCachedEntry(c, entry, res)
 	} else {
 		// Wait and retry logic with a maximum retry limit
 		retries := 0
@@ -100,104 +193,383 @@ func (s *APIServer) serveStatic(c *fiber.Ctx) error {
 	}
 }
 
-func fetchProcessAndCacheContent(c *fiber.Ctx, rdb *redis.Client, originURL, cacheKey, path, widthStr, heightStr string) error {
-	ctx := context.Background()
+func serveCachedEntry(c *fiber.Ctx, entry *cachedEntry, res *resource) error {
+	path := res.path
+
+	// Replay the headers the origin sent with the response
+	replayHeaders(c, entry.meta)
+	setCacheStatus(c, res, entry)
+
+	// Redirects and errors are sent with the status the origin answered with
+	if status := entry.statusCode(); status != http.StatusOK {
+		c.Status(status)
+		if entry.stream != nil {
+			c.Set("Content-Type", entry.contentType)
+			return c.SendStream(entry.stream, int(entry.contentLength))
+		}
+		c.Set("Content-Type", entryContentType(entry, path, entry.content))
+		return c.Send(entry.content)
+	}
+
+	// Answer revalidation requests with the ETag and Last-Modified of the entry,
+	// the generic etag middleware is skipped here because it would buffer streamed bodies
+	if entry.stream == nil && notModified(c, entry.meta) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	// Determine if the entry is a file on disk, content or still streaming
+	if entry.stream != nil {
+		c.Set("Content-Type", entry.contentType)
+		return c.SendStream(entry.stream, int(entry.contentLength))
+	}
+
+	c.Set("Accept-Ranges", "bytes")
+	if c.Get("Range") != "" && ifRangeMatches(c.Get("If-Range"), entry.meta) {
+		if handled, err := serveRanges(c, entry, path); handled {
+			return err
+		}
+	}
+
+	if entry.filePath != "" {
+		// The whole file is served, keep SendFile from applying the Range itself
+		c.Request().Header.Del("Range")
+		if err := c.SendFile(entry.filePath); err != nil {
+			return err
+		}
+		// SendFile sniffs the type of the extensionless cache file
+		if entry.meta != nil && entry.meta.ContentType != "" {
+			c.Set("Content-Type", entry.meta.ContentType)
+		}
+		return nil
+	} else {
+		contentType := entryContentType(entry, path, entry.content)
+		c.Set("Content-Type", contentType)
+		return c.Send(entry.content)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using the
+// weak comparison of RFC 9110.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// serveStale serves an expired entry, flagging it with a Warning header.
+func serveStale(c *fiber.Ctx, cached *cachedEntry, res *resource, warning string) error {
+	c.Set("Warning", warning)
+	cached.cacheStatus = cacheStale
+	return serveCachedEntry(c, cached, res)
+}
+
+func sendFetchError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errOriginTimeout):
+		return c.Status(fiber.StatusGatewayTimeout).SendString("Gateway Timeout")
+	case errors.Is(err, errOriginUnavailable):
+		return c.Status(fiber.StatusBadGateway).SendString("Bad Gateway")
+	case errors.Is(err, errImageProcessing):
+		return c.Status(fiber.StatusInternalServerError).SendString("Image Processing Error")
+	default:
+		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+	}
+}
+
+// fetchInBackground revalidates a stale entry, or caches a missing one when
+// cached is nil, without blocking the client.
+func fetchInBackground(store cache.CacheStore, res *resource, cached *cachedEntry) {
+	locked, err := store.Lock(res.cacheKey, 30*time.Second)
+	if err != nil {
+		log.Printf("Error acquiring lock: %v", err)
+		return
+	}
+	if !locked {
+		// Someone else is already refreshing this entry
+		return
+	}
+	defer store.Unlock(res.cacheKey)
 
-	// Check if the URL starts with "https://"
-	if !strings.HasPrefix(originURL, "https://") {
-		originURL = "https://" + originURL
+	if _, err := fetchProcessAndCacheContent(store, res, cached, false); err != nil {
+		log.Printf("Error refreshing %s in background: %v", res.cacheKey, err)
 	}
+}
+
+// fetchProcessAndCacheContent fetches the resource from the origin, processes and
+// caches it, and returns the entry to serve. When an expired entry with validators
+// is passed in, a conditional request is sent and a 304 only refreshes its TTL.
+// stream allows large bodies to be returned as a stream for a waiting client.
+func fetchProcessAndCacheContent(store cache.CacheStore, res *resource, cached *cachedEntry, stream bool) (*cachedEntry, error) {
+	revalidating := cached != nil && cached.meta != nil && cached.meta.HasValidators()
 
 	// Fetch from the origin server
-	resp, err := http.Get(originURL)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		log.Printf("Error fetching from origin: %v", err)
-		return c.Status(fiber.StatusNotFound).SendString("File Not Found")
+	resp, err := fetchFromOrigin(res, http.MethodGet, func(req *http.Request) {
+		if !revalidating {
+			return
+		}
+		if cached.meta.ETag != "" {
+			req.Header.Set("If-None-Match", cached.meta.ETag)
+		}
+		if cached.meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.meta.LastModified)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if revalidating && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		// Not modified, keep the cached body and extend its lifetime
+		cacheExpireTime, cacheable := getCacheExpireTime(resp.Header, siteDefaultTTL(res.origin))
+		if cacheable {
+			refreshCacheEntry(store, res, cached, resp.Header, cacheExpireTime)
+		}
+		cached.cacheStatus = cacheRevalidated
+		return cached, nil
+	}
+
+	// Keep serving the cached copy rather than replacing it with the error
+	if resp.StatusCode >= http.StatusInternalServerError && cached != nil && cached.meta.CanServeStaleIfError() {
+		resp.Body.Close()
+		log.Printf("Error fetching from origin: status %d", resp.StatusCode)
+		return nil, errOriginUnavailable
+	}
+
+	entry, err := processAndCacheResponse(store, res, resp, stream)
+	if entry != nil && entry.cacheStatus == cacheMiss && cached != nil {
+		entry.cacheStatus = cacheExpired
+	}
+	return entry, err
+}
+
+// refreshCacheEntry extends the lifetime of a cached value after a 304 from the origin.
+func refreshCacheEntry(store cache.CacheStore, res *resource, cached *cachedEntry, header http.Header, cacheExpireTime time.Duration) {
+	meta := cached.meta
+
+	// A 304 may carry updated validators and caching directives
+	if etag := header.Get("ETag"); etag != "" {
+		meta.ETag = etag
+	}
+	if lastModified := header.Get("Last-Modified"); lastModified != "" {
+		meta.LastModified = lastModified
+	}
+	if header.Get("Cache-Control") != "" {
+		meta.StaleWhileRevalidate, meta.StaleIfError = getStaleWindows(header)
+	}
+	if tags := getSurrogateKeys(header); len(tags) > 0 {
+		meta.Tags = tags
+	}
+	meta.Header = updateStoredHeaders(meta.Header, header)
+	meta.StoredAt = time.Now().Unix()
+	meta.ExpiresAt = time.Now().Add(cacheExpireTime).Unix()
+	meta.SoftPurged = false
+	retention := meta.Retention(cacheExpireTime)
+
+	if err := store.SetMeta(res.cacheKey, meta, retention); err != nil {
+		log.Printf("Error refreshing cache entry: %v", err)
+	}
+	// The variant must not outlive the index leading to it
+	if len(res.vary) > 0 {
+		storeVaryIndex(store, res.baseKey, res.vary, meta, retention)
+	}
+}
+
+// processAndCacheResponse processes and caches an origin response. Large bodies
+// that need no transformation are streamed instead of being read into memory:
+// with stream set the returned entry carries a reader that feeds the client and
+// the cache file at the same time, otherwise the body is written to disk first.
+func processAndCacheResponse(store cache.CacheStore, res *resource, resp *http.Response, stream bool) (*cachedEntry, error) {
+	// The body is closed here unless it is handed to a stream
+	streaming := false
+	defer func() {
+		if !streaming {
+			resp.Body.Close()
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		entry, err := processErrorResponse(store, res, resp, stream)
+		streaming = entry != nil && entry.stream != nil
+		return entry, err
 	}
-	defer resp.Body.Close()
 
-	// Read the content
-	fileContent, err := io.ReadAll(resp.Body)
+	meta, retention, cacheable := newCacheMeta(resp.Header, res.origin)
+
+	// Responses varying on request headers are stored per variant. The variant is
+	// selected by the headers the origin was sent, not the ones of the client:
+	// before the origin is known to vary on a header it is not forwarded, and the
+	// response is the one for requests without it.
+	vary, varyCacheable := varyHeaders(resp.Header)
+	cacheable = cacheable && varyCacheable
+	cacheKey := res.baseKey
+	if len(vary) > 0 {
+		cacheKey = variantKey(res.baseKey, vary, resp.Request.Header)
+		if cacheable {
+			storeVaryIndex(store, res.baseKey, vary, meta, retention)
+		}
+	}
+
+	// Read the beginning of the content, enough to decide how to handle it
+	fileContent, err := io.ReadAll(io.LimitReader(resp.Body, maxRedisValueSize+1))
 	if err != nil {
 		log.Printf("Error reading origin response: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		return nil, originError(err)
 	}
 
 	// Determine the content type
-	contentType := getContentType(path, fileContent)
-	c.Set("Content-Type", contentType)
+	contentType := getContentType(res.path, fileContent)
+	meta.ContentType = originContentType(resp.Header, contentType)
+
+	if len(fileContent) > maxRedisValueSize && !needsProcessing(contentType, res) {
+		// Large content served as is, never hold all of it in memory
+		body := io.MultiReader(bytes.NewReader(fileContent), resp.Body)
+		if !cacheable {
+			if !stream {
+				return &cachedEntry{meta: meta, cacheStatus: cacheBypass}, nil
+			}
+			streaming = true
+			return &cachedEntry{stream: struct {
+				io.Reader
+				io.Closer
+			}{body, resp.Body}, contentType: meta.ContentType, contentLength: resp.ContentLength, meta: meta, cacheStatus: cacheBypass}, nil
+		}
+
+		filler, err := newCacheFillReader(cacheKey, body, resp.ContentLength, resp.Body, func(filePath string, size int64, contentHash string) {
+			// Only register the file once it is completely written
+			meta.Size, meta.ContentHash = size, contentHash
+			storeFileEntry(store, cacheKey, filePath, meta, retention)
+		})
+		if err != nil {
+			log.Printf("Error creating cache file: %v", err)
+			return nil, err
+		}
+		streaming = true
+		if stream {
+			return &cachedEntry{stream: filler, contentType: meta.ContentType, contentLength: resp.ContentLength, meta: meta, cacheStatus: cacheMiss}, nil
+		}
+		filePath, err := filler.fill()
+		if err != nil {
+			log.Printf("Error saving file to disk: %v", err)
+			return nil, err
+		}
+		return &cachedEntry{filePath: filePath, meta: meta, cacheStatus: cacheMiss}, nil
+	}
+
+	// Read the rest of the content
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Error reading origin response: %v", err)
+		return nil, originError(err)
+	}
+	fileContent = append(fileContent, rest...)
 
 	// Process content based on type
 	if contentType == "text/css" || contentType == "application/javascript" {
 		// Minify CSS or JS
 		fileContent = minifyContent(contentType, fileContent)
-	} else if isImage(contentType) && (widthStr != "" || heightStr != "") {
+	} else if isImage(contentType) && (res.widthStr != "" || res.heightStr != "") {
 		// Resize image
-		fileContent, err = resizeImage(fileContent, widthStr, heightStr)
+		fileContent, err = resizeImage(fileContent, res.widthStr, res.heightStr)
 		if err != nil {
 			log.Printf("Error resizing image: %v", err)
-			return c.Status(fiber.StatusInternalServerError).SendString("Image Processing Error")
+			return nil, errImageProcessing
 		}
 	}
 
-	//get cache expire time
-	cacheExpireTime := getCacheExpireTime(contentType)
+	meta.Size = int64(len(fileContent))
+	meta.ContentHash = contentHash(fileContent)
 
-	// Decide whether to store content in Redis or on disk
+	if !cacheable {
+		return &cachedEntry{content: fileContent, meta: meta, cacheStatus: cacheBypass}, nil
+	}
+
+	// Decide whether to store content in the cache store or on disk
 	if len(fileContent) <= maxRedisValueSize {
-		// Store content directly in Redis
-		if err := rdb.Set(ctx, cacheKey, fileContent, cacheExpireTime).Err(); err != nil {
-			log.Printf("Error caching content in Redis: %v", err)
-		}
+		// Store content directly in the cache store
+		storeContentEntry(store, cacheKey, fileContent, meta, retention)
 		// Serve the content
-		return c.Send(fileContent)
+		return &cachedEntry{content: fileContent, meta: meta, cacheStatus: cacheMiss}, nil
 	} else {
 		// Store file on disk
 		filePath, err := saveFileToDisk(cacheKey, fileContent)
 		if err != nil {
 			log.Printf("Error saving file to disk: %v", err)
-			return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
-		}
-		// Store file path in Redis
-		if err := rdb.Set(ctx, cacheKey, "file:"+filePath, cacheExpireTime).Err(); err != nil {
-			log.Printf("Error caching file path in Redis: %v", err)
-		}
-		// Add entry to the sorted set with expiration timestamp
-		expiration := time.Now().Add(cacheExpireTime)
-		if err := rdb.ZAdd(ctx, fileTrackingZSet, &redis.Z{
-			Score:  float64(expiration.Unix()),
-			Member: filePath,
-		}).Err(); err != nil {
-			log.Printf("Error adding file to tracking ZSet: %v", err)
+			return nil, err
 		}
+		storeFileEntry(store, cacheKey, filePath, meta, retention)
 		// Serve the file
-		return c.SendFile(filePath)
+		return &cachedEntry{filePath: filePath, meta: meta, cacheStatus: cacheMiss}, nil
 	}
 }
 
-func getCacheExpireTime(contentType string) time.Duration {
+// newCacheMeta builds the metadata of an origin response from its headers and
+// returns how long the entry must be retained. cacheable is false when the
+// response may not be stored at all.
+func newCacheMeta(header http.Header, origin *models.OriginServer) (*cache.Meta, time.Duration, bool) {
+	//get cache expire time from the origin caching headers
+	cacheExpireTime, cacheable := getCacheExpireTime(header, siteDefaultTTL(origin))
+	staleWhileRevalidate, staleIfError := getStaleWindows(header)
+	meta := &cache.Meta{
+		ETag:                 header.Get("ETag"),
+		LastModified:         header.Get("Last-Modified"),
+		StoredAt:             time.Now().Unix(),
+		ExpiresAt:            time.Now().Add(cacheExpireTime).Unix(),
+		StaleWhileRevalidate: staleWhileRevalidate,
+		StaleIfError:         staleIfError,
+		Tags:                 getSurrogateKeys(header),
+		StatusCode:           http.StatusOK,
+		Header:               storedHeaders(header),
+		FetchedAt:            time.Now().Unix(),
+	}
+	// Keep the entry past its freshness for revalidation and stale serving
+	retention := meta.Retention(cacheExpireTime)
+	// The origin may not allow us to keep this response
+	return meta, retention, cacheable && retention > 0
+}
 
-	if strings.HasPrefix(contentType, "image/") {
-		return 60 * time.Minute
+// needsProcessing reports whether content is minified or resized before caching.
+func needsProcessing(contentType string, res *resource) bool {
+	if contentType == "text/css" || contentType == "application/javascript" {
+		return true
 	}
-	return 60 * time.Minute
+	return isImage(contentType) && (res.widthStr != "" || res.heightStr != "")
 }
 
-func saveFileToDisk(cacheKey string, content []byte) (string, error) {
-	// Define the base directory for cached files
-	baseDir := "./.cache"
+// storeContentEntry caches content directly in the cache store.
+func storeContentEntry(store cache.CacheStore, cacheKey string, content []byte, meta *cache.Meta, retention time.Duration) {
+	if err := store.Set(cacheKey, &cache.Entry{Content: content, Meta: meta}, retention); err != nil {
+		log.Printf("Error caching content: %v", err)
+	}
+}
 
+// storeFileEntry registers a file in the cache directory with the cache store.
+func storeFileEntry(store cache.CacheStore, cacheKey, filePath string, meta *cache.Meta, retention time.Duration) {
+	if err := store.Set(cacheKey, &cache.Entry{FilePath: filePath, Meta: meta}, retention); err != nil {
+		log.Printf("Error caching file path: %v", err)
+	}
+}
+
+func saveFileToDisk(cacheKey string, content []byte) (string, error) {
 	// Ensure the base directory exists
-	err := os.MkdirAll(baseDir, os.ModePerm)
+	err := os.MkdirAll(cache.BaseDir, os.ModePerm)
 	if err != nil {
 		return "", err
 	}
 
-	// Generate a safe file name based on the cache key
-	fileName := generateSafeFileName(cacheKey)
-
 	// Full path to the cached file
-	filePath := filepath.Join(baseDir, fileName)
+	filePath := cache.FilePath(cacheKey)
+
+	// Make room for the file within the disk budget
+	cache.Reserve(int64(len(content)))
 
 	// Write the content to the file
 	err = os.WriteFile(filePath, content, 0644)
@@ -208,12 +580,19 @@ func saveFileToDisk(cacheKey string, content []byte) (string, error) {
 	return filePath, nil
 }
 
-func generateSafeFileName(cacheKey string) string {
-	// Use a hash function to generate a unique file name
-	h := sha256.New()
-	h.Write([]byte(cacheKey))
-	fileName := hex.EncodeToString(h.Sum(nil))
-	return fileName
+// originContentType returns the Content-Type the origin sent, or the detected
+// one when it sent none.
+func originContentType(header http.Header, detected string) string {
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		return contentType
+	}
+	return detected
+}
+
+// contentHash returns the hex SHA-256 of a body.
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
 }
 
 func getContentType(path string, content []byte) string {
@@ -263,16 +642,6 @@ func resizeImage(imageData []byte, widthStr, heightStr string) ([]byte, error) {
 	return newImage, nil
 }
 
-func acquireLock(rdb *redis.Client, key string, ttl time.Duration) (bool, error) {
-	ctx := context.Background()
-	return rdb.SetNX(ctx, "lock:"+key, 1, ttl).Result()
-}
-
-func releaseLock(rdb *redis.Client, key string) {
-	ctx := context.Background()
-	rdb.Del(ctx, "lock:"+key)
-}
-
 var m *minify.M
 
 func init() {
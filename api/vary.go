@@ -0,0 +1,118 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zhitoo/cdn/cache"
+)
+
+// varyForwardHeaders are request headers sent to the origin even before it is
+// known to vary on them, so the first response is already negotiated.
+var varyForwardHeaders = []string{"Accept", "Accept-Language"}
+
+// requestHeader copies the request headers of c. Fiber reuses their memory once
+// the handler returns, and the resource may outlive it in a background fetch.
+func requestHeader(c *fiber.Ctx) http.Header {
+	header := http.Header{}
+	for name, values := range c.GetReqHeaders() {
+		for _, value := range values {
+			header.Add(strings.Clone(name), strings.Clone(value))
+		}
+	}
+	return header
+}
+
+// varyHeaders returns the sorted request headers an origin response varies on.
+// Accept-Encoding is left out: bodies are stored decoded and compressed per
+// client by the CDN itself. ok is false for "Vary: *", which is never cached.
+func varyHeaders(header http.Header) (names []string, ok bool) {
+	seen := map[string]bool{}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			switch {
+			case name == "*":
+				return nil, false
+			case name == "" || name == "Accept-Encoding" || seen[name]:
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// normalizeHeaderValue maps equivalent request header values to the same
+// variant: case and whitespace do not matter for content negotiation.
+func normalizeHeaderValue(name string, values []string) string {
+	value := strings.Join(values, ",")
+	switch name {
+	case "Accept", "Accept-Language":
+		value = strings.ToLower(strings.Join(strings.Fields(value), ""))
+	default:
+		value = strings.Join(strings.Fields(value), " ")
+	}
+	return value
+}
+
+// variantKey is the cache key of the variant of baseKey selected by the values
+// of the vary headers in a request.
+func variantKey(baseKey string, vary []string, header http.Header) string {
+	h := sha256.New()
+	for _, name := range vary {
+		h.Write([]byte(name + ":" + normalizeHeaderValue(name, header.Values(name)) + "\n"))
+	}
+	return baseKey + "#vary=" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// isVaryIndex reports whether the entry is the variant index of a base key
+// rather than a response.
+func (e *cachedEntry) isVaryIndex() bool {
+	return e.meta != nil && len(e.meta.Vary) > 0
+}
+
+// lookupEntry reads the cached entry of a resource. When the origin varies the
+// response, the base key holds a variant index and res.cacheKey is switched to
+// the key of the variant matching the request.
+func lookupEntry(store cache.CacheStore, res *resource) *cachedEntry {
+	cached := getCachedEntry(store, res.cacheKey)
+	if cached == nil || !cached.isVaryIndex() {
+		return cached
+	}
+	res.vary = cached.meta.Vary
+	res.cacheKey = variantKey(res.baseKey, res.vary, res.header)
+	return getCachedEntry(store, res.cacheKey)
+}
+
+// storeVaryIndex records the headers the responses of baseKey vary on.
+func storeVaryIndex(store cache.CacheStore, baseKey string, vary []string, meta *cache.Meta, retention time.Duration) {
+	index := &cache.Meta{
+		StoredAt:  meta.StoredAt,
+		ExpiresAt: meta.ExpiresAt,
+		Vary:      vary,
+	}
+	storeContentEntry(store, baseKey, nil, index, retention)
+}
+
+// forwardRequestHeaders copies the request headers the origin may vary on and
+// the ones its site forwards to an origin request.
+func forwardRequestHeaders(req *http.Request, res *resource) {
+	for _, names := range [][]string{varyForwardHeaders, res.vary, res.forwardHeaders} {
+		for _, name := range names {
+			if req.Header.Get(name) != "" {
+				continue
+			}
+			for _, value := range res.header.Values(name) {
+				req.Header.Add(name, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhitoo/cdn/cache"
+)
+
+func TestVaryHeaders(t *testing.T) {
+	tests := []struct {
+		name  string
+		vary  []string
+		names []string
+		ok    bool
+	}{
+		{"none", nil, nil, true},
+		{"sorted and canonical", []string{"accept-language, X-Device"}, []string{"Accept-Language", "X-Device"}, true},
+		{"several headers", []string{"X-Device", "Accept"}, []string{"Accept", "X-Device"}, true},
+		{"duplicates", []string{"Accept, accept"}, []string{"Accept"}, true},
+		{"accept-encoding ignored", []string{"Accept-Encoding"}, nil, true},
+		{"star", []string{"Accept, *"}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, ok := varyHeaders(http.Header{"Vary": tt.vary})
+			if !reflect.DeepEqual(names, tt.names) || ok != tt.ok {
+				t.Errorf("got (%v, %v), want (%v, %v)", names, ok, tt.names, tt.ok)
+			}
+		})
+	}
+}
+
+func TestVariantKey(t *testing.T) {
+	vary := []string{"Accept-Language", "X-Device"}
+	key := func(header http.Header) string {
+		return variantKey("s:/a", vary, header)
+	}
+	tests := []struct {
+		name string
+		a, b http.Header
+		same bool
+	}{
+		{"same values", http.Header{"X-Device": {"mobile"}}, http.Header{"X-Device": {"mobile"}}, true},
+		{"other values", http.Header{"X-Device": {"mobile"}}, http.Header{"X-Device": {"desktop"}}, false},
+		{"missing header", http.Header{"X-Device": {"mobile"}}, http.Header{}, false},
+		{"other headers ignored", http.Header{"X-Other": {"1"}}, http.Header{}, true},
+		{"negotiation case and spaces", http.Header{"Accept-Language": {"en-US, fr"}}, http.Header{"Accept-Language": {"EN-us,fr"}}, true},
+		{"whitespace", http.Header{"X-Device": {"big  phone"}}, http.Header{"X-Device": {"big phone"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := key(tt.a), key(tt.b)
+			if !strings.HasPrefix(a, "s:/a#vary=") {
+				t.Errorf("key %q is not a variant of s:/a", a)
+			}
+			if (a == b) != tt.same {
+				t.Errorf("keys %q and %q, want same = %v", a, b, tt.same)
+			}
+		})
+	}
+}
+
+func TestRefreshCacheEntryExtendsVaryIndex(t *testing.T) {
+	saved := cache.BaseDir
+	cache.BaseDir = t.TempDir()
+	defer func() { cache.BaseDir = saved }()
+
+	store := cache.NewMemoryStore(0)
+	res := &resource{baseKey: "s:/a", vary: []string{"Accept-Encoding"}}
+	res.cacheKey = variantKey(res.baseKey, res.vary, http.Header{"Accept-Encoding": {"gzip"}})
+	expired := time.Now().Add(-time.Minute).Unix()
+	store.Set(res.cacheKey, &cache.Entry{Content: []byte("a"), Meta: &cache.Meta{ExpiresAt: expired}}, time.Minute)
+	store.Set(res.baseKey, &cache.Entry{Meta: &cache.Meta{ExpiresAt: expired, Vary: res.vary}}, time.Minute)
+
+	cached := &cachedEntry{meta: &cache.Meta{ExpiresAt: expired}}
+	refreshCacheEntry(store, res, cached, http.Header{}, time.Hour)
+
+	for _, key := range []string{res.cacheKey, res.baseKey} {
+		meta, _ := store.Stat(key)
+		if meta == nil || !meta.IsFresh() {
+			t.Errorf("%s not refreshed: %+v", key, meta)
+		}
+	}
+	if index, _ := store.Stat(res.baseKey); index != nil && !reflect.DeepEqual(index.Vary, res.vary) {
+		t.Errorf("index Vary = %v, want %v", index.Vary, res.vary)
+	}
+}
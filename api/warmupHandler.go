@@ -0,0 +1,128 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zhitoo/cdn/config"
+	"github.com/zhitoo/cdn/requests"
+)
+
+// WarmUpResult reports the outcome of prefetching one URL into the cache.
+type WarmUpResult struct {
+	URL     string `json:"url"`
+	Success bool   `json:"success"`
+	// Size of the cached body in bytes
+	Size int64 `json:"size"`
+	// TTL is how many seconds the entry stays fresh, 0 when it was not cacheable
+	TTL   int64  `json:"ttl"`
+	Error string `json:"error,omitempty"`
+}
+
+// warmUpCache handles POST /warmup, prefetching a list of URLs into the cache.
+func (s *APIServer) warmUpCache(c *fiber.Ctx) error {
+	payload := new(requests.WarmUpRequest)
+
+	if err := c.BodyParser(payload); err != nil {
+		return err
+	}
+	// Validation
+	errs := s.validator.Validate(payload)
+	if errs != nil {
+		return c.Status(422).JSON(errs)
+	}
+
+	if !validAPIKey(payload.APIKey) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"results": s.WarmUp(payload.URLs, payload.Concurrency),
+	})
+}
+
+// WarmUp fetches every URL through the regular origin pipeline with at most
+// concurrency requests in flight. URLs have the form
+// siteIdentifier/path?width=&height=, optionally with a leading slash or a CDN
+// scheme and host. Results are returned in the order of urls.
+func (s *APIServer) WarmUp(urls []string, concurrency int) []WarmUpResult {
+	if concurrency <= 0 {
+		concurrency = int(config.Envs.WarmUpConcurrency)
+	}
+
+	results := make([]WarmUpResult, len(urls))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, rawURL := range urls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, rawURL string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = s.warmUpURL(rawURL)
+		}(i, rawURL)
+	}
+	wg.Wait()
+	return results
+}
+
+func (s *APIServer) warmUpURL(rawURL string) WarmUpResult {
+	result := WarmUpResult{URL: rawURL}
+
+	entry, err := s.warmUpEntry(rawURL)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	if status := entry.statusCode(); status != http.StatusOK {
+		result.Error = fmt.Sprintf("origin responded with status %d", status)
+		return result
+	}
+
+	result.Success = true
+	result.Size = entry.size()
+	if entry.meta != nil {
+		result.TTL = max(entry.meta.ExpiresAt-time.Now().Unix(), 0)
+	}
+	return result
+}
+
+func (s *APIServer) warmUpEntry(rawURL string) (*cachedEntry, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errInvalidURL
+	}
+	res, err := newResource(u.Path, u.Query())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.resolveOrigin(res); err != nil {
+		return nil, err
+	}
+	res.applyCacheKeyPolicy(u.RawQuery)
+
+	// Nothing to do when a fresh copy is already cached
+	cached := lookupEntry(s.store, res)
+	if cached != nil && cached.isFresh() {
+		return cached, nil
+	}
+
+	locked, err := s.store.Lock(res.cacheKey, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, errors.New("already being fetched")
+	}
+	defer s.store.Unlock(res.cacheKey)
+
+	return fetchProcessAndCacheContent(s.store, res, cached, false)
+}
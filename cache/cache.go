@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zhitoo/cdn/config"
+)
+
+// BaseDir is the directory cached files are stored in
+var BaseDir = config.Envs.CacheDir
+
+// CacheStore keeps cached entries and their metadata. Bodies are either held by
+// the store itself or are files in BaseDir named after the cache key.
+type CacheStore interface {
+	// Get returns the entry stored under key, nil when there is none
+	Get(key string) (*Entry, error)
+	// Stat returns the metadata of an entry without reading its body
+	Stat(key string) (*Meta, error)
+	// Set stores an entry, which is kept for retention
+	Set(key string, entry *Entry, retention time.Duration) error
+	// SetMeta replaces the metadata and retention of an existing entry
+	SetMeta(key string, meta *Meta, retention time.Duration) error
+	// Delete removes an entry, its file and its tag index entries
+	Delete(key string) (bool, error)
+	// Iterate calls fn for every entry whose key starts with prefix
+	Iterate(prefix string, fn func(key string, meta *Meta) error) error
+	// TaggedKeys returns the keys of a site's entries carrying tag
+	TaggedKeys(siteIdentifier, tag string) ([]string, error)
+	// Lock takes a lock on key for at most ttl, so only one request fetches it
+	Lock(key string, ttl time.Duration) (bool, error)
+	Unlock(key string)
+	// CleanUp removes expired entries and their files
+	CleanUp()
+}
+
+// Entry is a cached body together with its metadata.
+type Entry struct {
+	Content  []byte // set when the body is held in memory
+	FilePath string // set when the body is stored on disk
+	Meta     *Meta
+	// Tier names the store an entry was read from: l1, redis, memory or disk
+	Tier string
+}
+
+// Meta is the metadata stored next to every cached body.
+type Meta struct {
+	// Validators sent by the origin, used for conditional revalidation
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// StoredAt is the unix time the response was fetched or last revalidated
+	StoredAt int64 `json:"stored_at"`
+	// ExpiresAt is the unix time until which the entry is fresh
+	ExpiresAt int64 `json:"expires_at"`
+	// Seconds after ExpiresAt the entry may still be served (RFC 5861)
+	StaleWhileRevalidate int64 `json:"stale_while_revalidate,omitempty"`
+	StaleIfError         int64 `json:"stale_if_error,omitempty"`
+	// Tags from the origin Surrogate-Key/Cache-Tag headers
+	Tags []string `json:"tags,omitempty"`
+	// SoftPurged entries must be revalidated before they are served again
+	SoftPurged bool `json:"soft_purged,omitempty"`
+	// ObjectSize is the size of the whole object for slices of large objects
+	ObjectSize int64 `json:"object_size,omitempty"`
+	// Vary marks the variant index of a base key, listing the request headers
+	// its responses vary on
+	Vary []string `json:"vary,omitempty"`
+
+	// The origin response, replayed on cache hits
+	StatusCode  int         `json:"status_code,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	ContentType string      `json:"content_type,omitempty"`
+	// FetchedAt is the unix time the body was fetched, revalidation keeps it
+	FetchedAt int64 `json:"fetched_at,omitempty"`
+	// Size and hex SHA-256 of the cached body
+	Size        int64  `json:"size,omitempty"`
+	ContentHash string `json:"content_hash,omitempty"`
+}
+
+func (m *Meta) IsFresh() bool {
+	return time.Now().Unix() < m.ExpiresAt
+}
+
+// Age returns the seconds since the entry was fetched from the origin.
+func (m *Meta) Age() int64 {
+	return max(time.Now().Unix()-m.StoredAt, 0)
+}
+
+func (m *Meta) CanServeStaleWhileRevalidate() bool {
+	return m != nil && !m.SoftPurged && time.Now().Unix() < m.ExpiresAt+m.StaleWhileRevalidate
+}
+
+func (m *Meta) CanServeStaleIfError() bool {
+	return m != nil && time.Now().Unix() < m.ExpiresAt+m.StaleIfError
+}
+
+func (m *Meta) HasValidators() bool {
+	return m.ETag != "" || m.LastModified != ""
+}
+
+// Retention returns how long the entry must be kept in the cache. Entries outlive
+// their freshness so they can be revalidated with the origin or served stale.
+func (m *Meta) Retention(ttl time.Duration) time.Duration {
+	grace := max(m.StaleWhileRevalidate, m.StaleIfError)
+	if m.HasValidators() {
+		grace = max(grace, config.Envs.CacheRevalidateWindow)
+	}
+	return ttl + time.Duration(grace)*time.Second
+}
+
+// SafeFileName generates a file name for a cache key.
+func SafeFileName(cacheKey string) string {
+	// Use a hash function to generate a unique file name
+	h := sha256.New()
+	h.Write([]byte(cacheKey))
+	fileName := hex.EncodeToString(h.Sum(nil))
+	return fileName
+}
+
+// FilePath is the path of the file holding the body of a cache key.
+func FilePath(cacheKey string) string {
+	return filepath.Join(BaseDir, SafeFileName(cacheKey))
+}
+
+// SiteOf returns the site identifier part of a cache key.
+func SiteOf(cacheKey string) string {
+	siteIdentifier, _, _ := strings.Cut(cacheKey, ":")
+	return siteIdentifier
+}
+
+func hasTag(meta *Meta, tag string) bool {
+	if meta == nil {
+		return false
+	}
+	for _, t := range meta.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhitoo/cdn/config"
+)
+
+const (
+	// usageRescanInterval is how often the disk usage is recounted, which
+	// picks up files written and deleted by other processes
+	usageRescanInterval = 30 * time.Second
+	// touchInterval limits how often the access time of a file is updated
+	touchInterval = time.Minute
+)
+
+// diskBudget keeps BaseDir below the configured maximum size by evicting the
+// least recently used files. The modification time of a file is its last
+// access, so every process of a host shares the same LRU order.
+type diskBudget struct {
+	mu       sync.Mutex
+	usage    int64
+	scanned  time.Time
+	maxUsage int64
+}
+
+var budget = &diskBudget{maxUsage: config.Envs.CacheMaxDiskSize}
+
+// Reserve makes room for a new file of size bytes in BaseDir, evicting least
+// recently used files when the cache would grow past CACHE_MAX_DISK_SIZE.
+func Reserve(size int64) {
+	budget.reserve(size)
+}
+
+// Touch records an access to a cached file. It reports false when the file no
+// longer exists, for example because it was evicted.
+func Touch(filePath string) bool {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false
+	}
+	if budget.maxUsage > 0 && time.Since(info.ModTime()) > touchInterval {
+		now := time.Now()
+		os.Chtimes(filePath, now, now)
+	}
+	return true
+}
+
+func (b *diskBudget) reserve(size int64) {
+	if b.maxUsage <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if time.Since(b.scanned) > usageRescanInterval {
+		files, err := b.scan()
+		if err != nil {
+			log.Printf("Error scanning cache directory: %v", err)
+			return
+		}
+		b.usage = totalSize(files)
+		b.scanned = time.Now()
+	}
+	b.usage += size
+	if b.usage > b.maxUsage {
+		b.evict(size)
+	}
+}
+
+// evict removes the least recently used files until the cache, including the
+// reserved bytes, uses at most 90% of its budget, so eviction does not run again
+// on the very next file. The caller must hold b.mu.
+func (b *diskBudget) evict(reserved int64) {
+	files, err := b.scan()
+	if err != nil {
+		log.Printf("Error scanning cache directory: %v", err)
+		return
+	}
+	b.usage = totalSize(files) + reserved
+	b.scanned = time.Now()
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	target := b.maxUsage / 10 * 9
+	for _, file := range files {
+		if b.usage <= target {
+			break
+		}
+		name := file.Name()
+		if err := os.Remove(filepath.Join(BaseDir, name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error evicting file %s: %v", name, err)
+			continue
+		}
+		// A DiskStore record without its body is useless
+		os.Remove(filepath.Join(BaseDir, name+".meta"))
+		b.usage -= file.Size()
+	}
+}
+
+func (b *diskBudget) scan() ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(BaseDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		// Records, locks, files being written and anything else sharing the
+		// directory are not cached bodies
+		if !isBodyFileName(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, info)
+	}
+	return files, nil
+}
+
+// isBodyFileName reports whether name is a SafeFileName, the file name of a
+// cached body.
+func isBodyFileName(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range name {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func totalSize(files []os.FileInfo) int64 {
+	var total int64
+	for _, file := range files {
+		total += file.Size()
+	}
+	return total
+}
@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskBudgetEvict(t *testing.T) {
+	dir := t.TempDir()
+	saved := BaseDir
+	BaseDir = dir
+	defer func() { BaseDir = saved }()
+
+	write := func(name string, size int, age time.Duration) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Now().Add(-age)
+		os.Chtimes(path, modTime, modTime)
+	}
+	oldest, older, newest := SafeFileName("a"), SafeFileName("b"), SafeFileName("c")
+	write(oldest, 400, 3*time.Hour)
+	write(oldest+".meta", 10, 3*time.Hour)
+	write(older, 400, 2*time.Hour)
+	write(newest, 400, time.Hour)
+	// Files that are not cached bodies are neither counted nor evicted
+	write("notes.txt", 5000, 4*time.Hour)
+	write(newest+".tmp", 5000, 4*time.Hour)
+
+	b := &diskBudget{maxUsage: 1000}
+	b.reserve(400)
+
+	tests := []struct {
+		name string
+		kept bool
+	}{
+		{oldest, false},
+		{oldest + ".meta", false},
+		{older, false},
+		{newest, true},
+		{"notes.txt", true},
+		{newest + ".tmp", true},
+	}
+	for _, tt := range tests {
+		_, err := os.Stat(filepath.Join(dir, tt.name))
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("%s kept = %v, want %v", tt.name, kept, tt.kept)
+		}
+	}
+	if b.usage != 800 {
+		t.Errorf("usage = %d, want 800", b.usage)
+	}
+}
@@ -0,0 +1,228 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DiskStore keeps every entry in BaseDir: the body in FilePath(key) and a JSON
+// record with the key and metadata next to it. Processes on the same host
+// share the cache, and it survives restarts without Redis.
+type DiskStore struct{}
+
+// diskRecord is the content of a ".meta" file.
+type diskRecord struct {
+	Key         string `json:"key"`
+	Meta        *Meta  `json:"meta,omitempty"`
+	RetainUntil int64  `json:"retain_until"`
+}
+
+func NewDiskStore() (*DiskStore, error) {
+	// Ensure the base directory exists
+	if err := os.MkdirAll(BaseDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &DiskStore{}, nil
+}
+
+func recordPath(key string) string {
+	return FilePath(key) + ".meta"
+}
+
+// readRecord reads the record of key, nil when there is no live entry.
+func (s *DiskStore) readRecord(path string) (*diskRecord, error) {
+	value, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := &diskRecord{}
+	if err := json.Unmarshal(value, record); err != nil {
+		return nil, nil
+	}
+	if time.Now().Unix() >= record.RetainUntil {
+		s.remove(record.Key)
+		return nil, nil
+	}
+	return record, nil
+}
+
+// writeRecord atomically replaces the record of key.
+func (s *DiskStore) writeRecord(record *diskRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return writeFile(recordPath(record.Key), value)
+}
+
+// writeFile writes a file through a temporary file, so readers never see it
+// partially written.
+func writeFile(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *DiskStore) remove(key string) {
+	for _, path := range []string{recordPath(key), FilePath(key)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error deleting file %s: %v", path, err)
+		}
+	}
+}
+
+func (s *DiskStore) Get(key string) (*Entry, error) {
+	record, err := s.readRecord(recordPath(key))
+	if record == nil || err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(FilePath(key)); err != nil {
+		// The body is gone, so is the entry
+		s.remove(key)
+		return nil, nil
+	}
+	return &Entry{FilePath: FilePath(key), Meta: record.Meta, Tier: "disk"}, nil
+}
+
+func (s *DiskStore) Stat(key string) (*Meta, error) {
+	record, err := s.readRecord(recordPath(key))
+	if record == nil || err != nil {
+		return nil, err
+	}
+	return record.Meta, nil
+}
+
+func (s *DiskStore) Set(key string, entry *Entry, retention time.Duration) error {
+	filePath := FilePath(key)
+	if entry.FilePath == "" {
+		Reserve(int64(len(entry.Content)))
+		if err := writeFile(filePath, entry.Content); err != nil {
+			return err
+		}
+	} else if entry.FilePath != filePath {
+		if err := os.Rename(entry.FilePath, filePath); err != nil {
+			return err
+		}
+	}
+	return s.writeRecord(&diskRecord{
+		Key:         key,
+		Meta:        entry.Meta,
+		RetainUntil: time.Now().Add(retention).Unix(),
+	})
+}
+
+func (s *DiskStore) SetMeta(key string, meta *Meta, retention time.Duration) error {
+	record, err := s.readRecord(recordPath(key))
+	if record == nil || err != nil {
+		return err
+	}
+	record.Meta = meta
+	record.RetainUntil = time.Now().Add(retention).Unix()
+	return s.writeRecord(record)
+}
+
+func (s *DiskStore) Delete(key string) (bool, error) {
+	record, err := s.readRecord(recordPath(key))
+	if record == nil || err != nil {
+		return false, err
+	}
+	s.remove(key)
+	return true, nil
+}
+
+// records calls fn with every live record in BaseDir.
+func (s *DiskStore) records(fn func(record *diskRecord) error) error {
+	files, err := os.ReadDir(BaseDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".meta") {
+			continue
+		}
+		record, err := s.readRecord(filepath.Join(BaseDir, file.Name()))
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			continue
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *DiskStore) Iterate(prefix string, fn func(key string, meta *Meta) error) error {
+	return s.records(func(record *diskRecord) error {
+		if !strings.HasPrefix(record.Key, prefix) {
+			return nil
+		}
+		return fn(record.Key, record.Meta)
+	})
+}
+
+func (s *DiskStore) TaggedKeys(siteIdentifier, tag string) ([]string, error) {
+	var keys []string
+	err := s.records(func(record *diskRecord) error {
+		if SiteOf(record.Key) == siteIdentifier && hasTag(record.Meta, tag) {
+			keys = append(keys, record.Key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Lock creates a lock file next to the entry. A lock file older than ttl was
+// left behind by a crashed process and is taken over.
+func (s *DiskStore) Lock(key string, ttl time.Duration) (bool, error) {
+	lockPath := FilePath(key) + ".lock"
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			file.Close()
+			return true, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return false, err
+		}
+		info, err := os.Stat(lockPath)
+		if err != nil || time.Since(info.ModTime()) < ttl {
+			return false, nil
+		}
+		os.Remove(lockPath)
+	}
+	return false, nil
+}
+
+func (s *DiskStore) Unlock(key string) {
+	os.Remove(FilePath(key) + ".lock")
+}
+
+// CleanUp removes entries past their retention, reading a record removes it
+// once it has expired.
+func (s *DiskStore) CleanUp() {
+	if err := s.records(func(*diskRecord) error { return nil }); err != nil {
+		log.Printf("Error cleaning up disk cache: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"hash/fnv"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// invalidationChannel is the Redis channel changed cache keys are announced on
+const invalidationChannel = "cache_invalidate"
+
+// entryOverhead approximates the memory an L1 entry takes besides its body
+const entryOverhead = 256
+
+// L1Store keeps hot entries in a size-bounded in-process LRU in front of another
+// store, so a hit needs no round trip to Redis. Every change of an entry is
+// published on Redis, which drops it from the L1 of every node and prefork child.
+type L1Store struct {
+	CacheStore
+	rdb     *redis.Client
+	nodeID  string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // front is the most recently used
+	entries map[string]*list.Element
+	// generations count invalidations per bucket of keys, so an entry read from
+	// the backend before an invalidation is not put back into the L1 after it
+	generations [256]uint64
+}
+
+type l1Entry struct {
+	key   string
+	entry Entry
+	size  int64
+}
+
+// NewL1Store puts an L1 of at most maxSize bytes in front of backend and starts
+// listening for invalidations from other processes.
+func NewL1Store(backend CacheStore, rdb *redis.Client, maxSize int64) *L1Store {
+	id := make([]byte, 8)
+	rand.Read(id)
+	s := &L1Store{
+		CacheStore: backend,
+		rdb:        rdb,
+		nodeID:     hex.EncodeToString(id),
+		maxSize:    maxSize,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+	}
+	go s.subscribe()
+	return s
+}
+
+// subscribe drops entries changed by other processes from the L1.
+func (s *L1Store) subscribe() {
+	pubsub := s.rdb.Subscribe(context.Background(), invalidationChannel)
+	for msg := range pubsub.Channel() {
+		// Messages are "nodeID key"
+		nodeID, key, ok := strings.Cut(msg.Payload, " ")
+		if !ok || nodeID == s.nodeID {
+			continue
+		}
+		s.remove(key)
+	}
+}
+
+// invalidate drops key from the L1 of this and every other process.
+func (s *L1Store) invalidate(key string) {
+	s.remove(key)
+	ctx := context.Background()
+	if err := s.rdb.Publish(ctx, invalidationChannel, s.nodeID+" "+key).Err(); err != nil {
+		log.Printf("Error publishing cache invalidation: %v", err)
+	}
+}
+
+// bucket returns the generation counter of key.
+func bucket(key string) uint8 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return uint8(h.Sum32())
+}
+
+func (s *L1Store) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generations[bucket(key)]++
+	if elem, ok := s.entries[key]; ok {
+		s.removeElement(elem)
+	}
+}
+
+// removeElement drops an entry from the LRU. The caller must hold s.mu.
+func (s *L1Store) removeElement(elem *list.Element) {
+	e := elem.Value.(*l1Entry)
+	s.lru.Remove(elem)
+	delete(s.entries, e.key)
+	s.size -= e.size
+}
+
+// add keeps an entry read at generation in the LRU, evicting the least recently
+// used entries to make room for it.
+func (s *L1Store) add(key string, entry *Entry, generation uint64) {
+	size := int64(len(key)+len(entry.Content)+len(entry.FilePath)) + entryOverhead
+	// Objects that would push out a large part of the L1 are not worth it
+	if entry.Meta == nil || size > s.maxSize/8 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if generation != s.generations[bucket(key)] {
+		return
+	}
+	if elem, ok := s.entries[key]; ok {
+		s.removeElement(elem)
+	}
+	stored := *entry
+	stored.Meta = copyMeta(entry.Meta)
+	s.entries[key] = s.lru.PushFront(&l1Entry{key: key, entry: stored, size: size})
+	s.size += size
+	for s.size > s.maxSize {
+		s.removeElement(s.lru.Back())
+	}
+}
+
+// Get answers from the L1 while the entry is fresh. Expired entries are read
+// from the backend again, which may have been revalidated by another node.
+func (s *L1Store) Get(key string) (*Entry, error) {
+	s.mu.Lock()
+	if elem, ok := s.entries[key]; ok {
+		e := elem.Value.(*l1Entry)
+		if e.entry.Meta.IsFresh() {
+			s.lru.MoveToFront(elem)
+			entry := e.entry
+			entry.Meta = copyMeta(e.entry.Meta)
+			entry.Tier = "l1"
+			s.mu.Unlock()
+			return &entry, nil
+		}
+		s.removeElement(elem)
+	}
+	generation := s.generations[bucket(key)]
+	s.mu.Unlock()
+
+	entry, err := s.CacheStore.Get(key)
+	if entry != nil && err == nil {
+		s.add(key, entry, generation)
+	}
+	return entry, err
+}
+
+func (s *L1Store) Set(key string, entry *Entry, retention time.Duration) error {
+	if err := s.CacheStore.Set(key, entry, retention); err != nil {
+		return err
+	}
+	s.invalidate(key)
+	s.mu.Lock()
+	generation := s.generations[bucket(key)]
+	s.mu.Unlock()
+	s.add(key, entry, generation)
+	return nil
+}
+
+func (s *L1Store) SetMeta(key string, meta *Meta, retention time.Duration) error {
+	err := s.CacheStore.SetMeta(key, meta, retention)
+	s.invalidate(key)
+	return err
+}
+
+func (s *L1Store) Delete(key string) (bool, error) {
+	deleted, err := s.CacheStore.Delete(key)
+	s.invalidate(key)
+	return deleted, err
+}
@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"container/list"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps entries in the memory of a single process, evicting the
+// least recently used ones beyond maxSize bytes. Large bodies still live as
+// files in BaseDir, bounded by CACHE_MAX_DISK_SIZE. It is meant for single-node
+// deployments without Redis and for tests.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+	locks   map[string]time.Time
+
+	maxSize int64 // 0 means unlimited
+	size    int64
+	lru     *list.List // keys, front is the most recently used
+}
+
+type memoryEntry struct {
+	entry       Entry
+	retainUntil time.Time
+	size        int64
+	elem        *list.Element
+}
+
+// NewMemoryStore creates a memory store holding at most maxSize bytes, 0 for
+// no limit.
+func NewMemoryStore(maxSize int64) *MemoryStore {
+	return &MemoryStore{
+		entries: map[string]*memoryEntry{},
+		locks:   map[string]time.Time{},
+		maxSize: maxSize,
+		lru:     list.New(),
+	}
+}
+
+// get returns a live entry, removing it when its retention has passed. The
+// caller must hold s.mu.
+func (s *MemoryStore) get(key string) *memoryEntry {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.retainUntil) {
+		s.remove(key, e)
+		return nil
+	}
+	return e
+}
+
+// remove deletes an entry and its file. The caller must hold s.mu.
+func (s *MemoryStore) remove(key string, e *memoryEntry) {
+	delete(s.entries, key)
+	s.lru.Remove(e.elem)
+	s.size -= e.size
+	if e.entry.FilePath != "" {
+		if err := os.Remove(e.entry.FilePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error deleting file %s: %v", e.entry.FilePath, err)
+		}
+	}
+}
+
+// copyMeta keeps callers from changing stored metadata in place.
+func copyMeta(meta *Meta) *Meta {
+	if meta == nil {
+		return nil
+	}
+	c := *meta
+	return &c
+}
+
+func (s *MemoryStore) Get(key string) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.get(key)
+	if e == nil {
+		return nil, nil
+	}
+	s.lru.MoveToFront(e.elem)
+	entry := e.entry
+	entry.Meta = copyMeta(entry.Meta)
+	entry.Tier = "memory"
+	return &entry, nil
+}
+
+func (s *MemoryStore) Stat(key string) (*Meta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.get(key)
+	if e == nil {
+		return nil, nil
+	}
+	s.lru.MoveToFront(e.elem)
+	return copyMeta(e.entry.Meta), nil
+}
+
+func (s *MemoryStore) Set(key string, entry *Entry, retention time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *entry
+	stored.Meta = copyMeta(entry.Meta)
+	if old, ok := s.entries[key]; ok {
+		if old.entry.FilePath == stored.FilePath {
+			// The file now belongs to the new entry
+			old.entry.FilePath = ""
+		}
+		s.remove(key, old)
+	}
+	size := int64(len(key)+len(stored.Content)+len(stored.FilePath)) + entryOverhead
+	s.entries[key] = &memoryEntry{
+		entry:       stored,
+		retainUntil: time.Now().Add(retention),
+		size:        size,
+		elem:        s.lru.PushFront(key),
+	}
+	s.size += size
+	for s.maxSize > 0 && s.size > s.maxSize && s.lru.Len() > 1 {
+		oldest := s.lru.Back().Value.(string)
+		s.remove(oldest, s.entries[oldest])
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetMeta(key string, meta *Meta, retention time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.get(key)
+	if e == nil {
+		return nil
+	}
+	e.entry.Meta = copyMeta(meta)
+	e.retainUntil = time.Now().Add(retention)
+	return nil
+}
+
+func (s *MemoryStore) Delete(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.get(key)
+	if e == nil {
+		return false, nil
+	}
+	s.remove(key, e)
+	return true, nil
+}
+
+func (s *MemoryStore) Iterate(prefix string, fn func(key string, meta *Meta) error) error {
+	// Collect the matching entries first, fn may change the store
+	s.mu.Lock()
+	metas := map[string]*Meta{}
+	for key := range s.entries {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if e := s.get(key); e != nil {
+			metas[key] = copyMeta(e.entry.Meta)
+		}
+	}
+	s.mu.Unlock()
+
+	for key, meta := range metas {
+		if err := fn(key, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) TaggedKeys(siteIdentifier, tag string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key, e := range s.entries {
+		if SiteOf(key) == siteIdentifier && hasTag(e.entry.Meta, tag) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) Lock(key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if until, ok := s.locks[key]; ok && time.Now().Before(until) {
+		return false, nil
+	}
+	s.locks[key] = time.Now().Add(ttl)
+	return true, nil
+}
+
+func (s *MemoryStore) Unlock(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.locks, key)
+}
+
+// CleanUp removes entries past their retention together with their files.
+func (s *MemoryStore) CleanUp() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.entries {
+		s.get(key)
+	}
+	for key, until := range s.locks {
+		if time.Now().After(until) {
+			delete(s.locks, key)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// fileTrackingZSet tracks the files of cached entries by the time they expire
+const fileTrackingZSet = "file_cache_tracker"
+
+// RedisStore keeps entries in Redis, sharing the cache between all CDN nodes.
+// Each entry is stored under its cache key as either the content itself or
+// "file:" followed by the path of the cached file, with its metadata under
+// "meta:"+key and its tags in "tag:"+site+":"+tag sets.
+type RedisStore struct {
+	rdb *redis.Client
+}
+
+func NewRedisStore(rdb *redis.Client) *RedisStore {
+	return &RedisStore{rdb: rdb}
+}
+
+func (s *RedisStore) Get(key string) (*Entry, error) {
+	ctx := context.Background()
+	value, err := s.rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta, err := s.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(value, "file:") {
+		return &Entry{FilePath: value[5:], Meta: meta, Tier: "redis"}, nil // Remove "file:" prefix
+	}
+	return &Entry{Content: []byte(value), Meta: meta, Tier: "redis"}, nil
+}
+
+func (s *RedisStore) Stat(key string) (*Meta, error) {
+	ctx := context.Background()
+	value, err := s.rdb.Get(ctx, "meta:"+key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := &Meta{}
+	if err := json.Unmarshal(value, meta); err != nil {
+		return nil, nil
+	}
+	return meta, nil
+}
+
+func (s *RedisStore) Set(key string, entry *Entry, retention time.Duration) error {
+	ctx := context.Background()
+	value := entry.Content
+	if entry.FilePath != "" {
+		// Store file path in Redis
+		value = []byte("file:" + entry.FilePath)
+	}
+	if err := s.rdb.Set(ctx, key, value, retention).Err(); err != nil {
+		return err
+	}
+	if entry.Meta != nil {
+		if err := s.setMeta(key, entry.Meta, retention); err != nil {
+			return err
+		}
+		s.addTags(key, entry.Meta.Tags, retention)
+	}
+	if entry.FilePath != "" {
+		s.trackFile(entry.FilePath, retention)
+	}
+	return nil
+}
+
+func (s *RedisStore) SetMeta(key string, meta *Meta, retention time.Duration) error {
+	ctx := context.Background()
+	value, err := s.rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.rdb.Expire(ctx, key, retention).Err(); err != nil {
+		return err
+	}
+	if err := s.setMeta(key, meta, retention); err != nil {
+		return err
+	}
+	s.addTags(key, meta.Tags, retention)
+	if strings.HasPrefix(value, "file:") {
+		// Keep the file on disk for as long as the entry
+		s.trackFile(value[5:], retention)
+	}
+	return nil
+}
+
+func (s *RedisStore) setMeta(key string, meta *Meta, retention time.Duration) error {
+	ctx := context.Background()
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Set(ctx, "meta:"+key, value, retention).Err()
+}
+
+// trackFile adds a file to the sorted set with its expiration timestamp.
+func (s *RedisStore) trackFile(filePath string, retention time.Duration) {
+	ctx := context.Background()
+	expiration := time.Now().Add(retention)
+	if err := s.rdb.ZAdd(ctx, fileTrackingZSet, &redis.Z{
+		Score:  float64(expiration.Unix()),
+		Member: filePath,
+	}).Err(); err != nil {
+		log.Printf("Error adding file to tracking ZSet: %v", err)
+	}
+}
+
+func (s *RedisStore) Delete(key string) (bool, error) {
+	ctx := context.Background()
+
+	value, err := s.rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if strings.HasPrefix(value, "file:") {
+		filePath := value[5:] // Remove "file:" prefix
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error deleting file %s: %v", filePath, err)
+		}
+		if err := s.rdb.ZRem(ctx, fileTrackingZSet, filePath).Err(); err != nil {
+			log.Printf("Error removing file %s from ZSet: %v", filePath, err)
+		}
+	}
+
+	if meta, _ := s.Stat(key); meta != nil {
+		s.removeTags(key, meta.Tags)
+	}
+
+	if err := s.rdb.Del(ctx, key, "meta:"+key).Err(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *RedisStore) Iterate(prefix string, fn func(key string, meta *Meta) error) error {
+	ctx := context.Background()
+	iter := s.rdb.Scan(ctx, 0, escapePattern(prefix)+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		meta, err := s.Stat(key)
+		if err != nil {
+			return err
+		}
+		if err := fn(key, meta); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// tagKey is the Redis set holding every cache key of a site tagged with tag.
+func tagKey(siteIdentifier, tag string) string {
+	return "tag:" + siteIdentifier + ":" + tag
+}
+
+func (s *RedisStore) TaggedKeys(siteIdentifier, tag string) ([]string, error) {
+	ctx := context.Background()
+	return s.rdb.SMembers(ctx, tagKey(siteIdentifier, tag)).Result()
+}
+
+// addTags records key in the index of each of its tags. The index lives at
+// least as long as the entry, so it never loses track of a cached key.
+func (s *RedisStore) addTags(key string, tags []string, retention time.Duration) {
+	ctx := context.Background()
+	siteIdentifier := SiteOf(key)
+	for _, tag := range tags {
+		setKey := tagKey(siteIdentifier, tag)
+		if err := s.rdb.SAdd(ctx, setKey, key).Err(); err != nil {
+			log.Printf("Error adding %s to tag %s: %v", key, tag, err)
+			continue
+		}
+		ttl, err := s.rdb.TTL(ctx, setKey).Result()
+		if err == nil && ttl < retention {
+			s.rdb.Expire(ctx, setKey, retention)
+		}
+	}
+}
+
+// removeTags drops key from the index of each of its tags.
+func (s *RedisStore) removeTags(key string, tags []string) {
+	ctx := context.Background()
+	siteIdentifier := SiteOf(key)
+	for _, tag := range tags {
+		s.rdb.SRem(ctx, tagKey(siteIdentifier, tag), key)
+	}
+}
+
+func (s *RedisStore) Lock(key string, ttl time.Duration) (bool, error) {
+	ctx := context.Background()
+	return s.rdb.SetNX(ctx, "lock:"+key, 1, ttl).Result()
+}
+
+func (s *RedisStore) Unlock(key string) {
+	ctx := context.Background()
+	s.rdb.Del(ctx, "lock:"+key)
+}
+
+// CleanUp deletes the files of expired entries. The entries themselves are
+// expired by Redis.
+func (s *RedisStore) CleanUp() {
+	ctx := context.Background()
+
+	now := time.Now().Unix()
+
+	// Get all file paths with expiration time less than or equal to now
+	expiredFiles, err := s.rdb.ZRangeByScore(ctx, fileTrackingZSet, &redis.ZRangeBy{
+		Min: "0",
+		Max: fmt.Sprintf("%d", now),
+	}).Result()
+	if err != nil {
+		log.Printf("Error fetching expired files from ZSet: %v", err)
+		return
+	}
+
+	for _, filePath := range expiredFiles {
+		// Delete the file from disk
+		err := os.Remove(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Error deleting file %s: %v", filePath, err)
+			continue
+		}
+
+		// Remove the file path from the sorted set
+		_, err = s.rdb.ZRem(ctx, fileTrackingZSet, filePath).Result()
+		if err != nil {
+			log.Printf("Error removing file %s from ZSet: %v", filePath, err)
+		}
+	}
+}
+
+// escapePattern escapes the glob characters Redis SCAN MATCH understands.
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
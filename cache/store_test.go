@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testStore runs the CacheStore contract against a new, empty store.
+func testStore(t *testing.T, newStore func(t *testing.T) CacheStore) {
+	body := func(t *testing.T, entry *Entry) string {
+		if entry.FilePath == "" {
+			return string(entry.Content)
+		}
+		content, err := os.ReadFile(entry.FilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	t.Run("get set stat", func(t *testing.T) {
+		s := newStore(t)
+		if entry, err := s.Get("site:/a"); entry != nil || err != nil {
+			t.Fatalf("Get of a missing key = %v, %v", entry, err)
+		}
+		if meta, err := s.Stat("site:/a"); meta != nil || err != nil {
+			t.Fatalf("Stat of a missing key = %v, %v", meta, err)
+		}
+		if err := s.Set("site:/a", &Entry{Content: []byte("hello"), Meta: &Meta{ETag: `"1"`}}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		entry, err := s.Get("site:/a")
+		if entry == nil || err != nil {
+			t.Fatalf("Get = %v, %v", entry, err)
+		}
+		if got := body(t, entry); got != "hello" {
+			t.Errorf("body = %q, want hello", got)
+		}
+		if entry.Meta.ETag != `"1"` {
+			t.Errorf("ETag = %s", entry.Meta.ETag)
+		}
+		meta, err := s.Stat("site:/a")
+		if meta == nil || err != nil || meta.ETag != `"1"` {
+			t.Errorf("Stat = %v, %v", meta, err)
+		}
+	})
+
+	t.Run("set meta", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.SetMeta("site:/missing", &Meta{}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if meta, _ := s.Stat("site:/missing"); meta != nil {
+			t.Errorf("SetMeta created an entry")
+		}
+		s.Set("site:/a", &Entry{Content: []byte("hello"), Meta: &Meta{ETag: `"1"`}}, time.Minute)
+		if err := s.SetMeta("site:/a", &Meta{ETag: `"2"`, SoftPurged: true}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		entry, _ := s.Get("site:/a")
+		if entry == nil || entry.Meta.ETag != `"2"` || !entry.Meta.SoftPurged {
+			t.Fatalf("Get after SetMeta = %+v", entry)
+		}
+		if got := body(t, entry); got != "hello" {
+			t.Errorf("body = %q, want hello", got)
+		}
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		s := newStore(t)
+		s.Set("site:/a", &Entry{Content: []byte("hello"), Meta: &Meta{}}, -time.Second)
+		if entry, _ := s.Get("site:/a"); entry != nil {
+			t.Errorf("entry outlived its retention")
+		}
+		s.Set("site:/b", &Entry{Content: []byte("hello"), Meta: &Meta{}}, time.Minute)
+		s.SetMeta("site:/b", &Meta{}, -time.Second)
+		if meta, _ := s.Stat("site:/b"); meta != nil {
+			t.Errorf("SetMeta did not replace the retention")
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		s := newStore(t)
+		if deleted, err := s.Delete("site:/a"); deleted || err != nil {
+			t.Fatalf("Delete of a missing key = %v, %v", deleted, err)
+		}
+		s.Set("site:/a", &Entry{Content: []byte("hello"), Meta: &Meta{}}, time.Minute)
+		if deleted, err := s.Delete("site:/a"); !deleted || err != nil {
+			t.Fatalf("Delete = %v, %v", deleted, err)
+		}
+		if entry, _ := s.Get("site:/a"); entry != nil {
+			t.Errorf("entry still there after Delete")
+		}
+	})
+
+	t.Run("iterate and tags", func(t *testing.T) {
+		s := newStore(t)
+		s.Set("site:/a", &Entry{Content: []byte("a"), Meta: &Meta{Tags: []string{"red"}}}, time.Minute)
+		s.Set("site:/b", &Entry{Content: []byte("b"), Meta: &Meta{Tags: []string{"red", "blue"}}}, time.Minute)
+		s.Set("site:/c", &Entry{Content: []byte("c"), Meta: &Meta{Tags: []string{"blue"}}}, time.Minute)
+		s.Set("other:/a", &Entry{Content: []byte("a"), Meta: &Meta{Tags: []string{"red"}}}, time.Minute)
+
+		var keys []string
+		err := s.Iterate("site:", func(key string, meta *Meta) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		if want := []string{"site:/a", "site:/b", "site:/c"}; !equalStrings(keys, want) {
+			t.Errorf("Iterate = %v, want %v", keys, want)
+		}
+
+		keys, err = s.TaggedKeys("site", "red")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		if want := []string{"site:/a", "site:/b"}; !equalStrings(keys, want) {
+			t.Errorf("TaggedKeys = %v, want %v", keys, want)
+		}
+	})
+
+	t.Run("lock", func(t *testing.T) {
+		s := newStore(t)
+		if locked, err := s.Lock("site:/a", time.Minute); !locked || err != nil {
+			t.Fatalf("Lock = %v, %v", locked, err)
+		}
+		if locked, _ := s.Lock("site:/a", time.Minute); locked {
+			t.Errorf("lock taken twice")
+		}
+		if locked, _ := s.Lock("site:/b", time.Minute); !locked {
+			t.Errorf("lock of another key not taken")
+		}
+		s.Unlock("site:/a")
+		if locked, _ := s.Lock("site:/a", time.Minute); !locked {
+			t.Errorf("lock not taken after Unlock")
+		}
+	})
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// useTempBaseDir points BaseDir to a directory removed after the test.
+func useTempBaseDir(t *testing.T) {
+	saved := BaseDir
+	BaseDir = t.TempDir()
+	t.Cleanup(func() { BaseDir = saved })
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) CacheStore {
+		useTempBaseDir(t)
+		return NewMemoryStore(0)
+	})
+}
+
+func TestDiskStore(t *testing.T) {
+	testStore(t, func(t *testing.T) CacheStore {
+		useTempBaseDir(t)
+		s, err := NewDiskStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	useTempBaseDir(t)
+	entrySize := int64(len("site:/a")+100) + entryOverhead
+	s := NewMemoryStore(3 * entrySize)
+	for _, key := range []string{"site:/a", "site:/b", "site:/c"} {
+		s.Set(key, &Entry{Content: make([]byte, 100), Meta: &Meta{}}, time.Minute)
+	}
+	// Reading a makes b the least recently used entry
+	s.Get("site:/a")
+	s.Set("site:/d", &Entry{Content: make([]byte, 100), Meta: &Meta{}}, time.Minute)
+
+	for _, tt := range []struct {
+		key  string
+		kept bool
+	}{
+		{"site:/a", true},
+		{"site:/b", false},
+		{"site:/c", true},
+		{"site:/d", true},
+	} {
+		if entry, _ := s.Get(tt.key); (entry != nil) != tt.kept {
+			t.Errorf("%s kept = %v, want %v", tt.key, entry != nil, tt.kept)
+		}
+	}
+}
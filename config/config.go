@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"strconv"
 
 	"github.com/joho/godotenv"
 )
@@ -13,6 +14,56 @@ type Config struct {
 	RedisHost     string
 	RedisPort     string
 	RedisPassword string
+	// CacheStore selects where cached entries are kept: redis, memory or disk
+	CacheStore string
+	// CacheDir is the directory cached files are stored in
+	CacheDir string
+	// CacheMaxDiskSize caps the size in bytes of CacheDir, 0 means unlimited.
+	// The least recently used files are evicted to stay below it.
+	CacheMaxDiskSize int64
+	// L1CacheSize is the size in bytes of the in-process cache in front of
+	// Redis, 0 disables it
+	L1CacheSize int64
+	// MemoryCacheSize caps the bytes the memory cache store holds in memory,
+	// 0 means unlimited. Large bodies are files counted in CacheMaxDiskSize.
+	MemoryCacheSize int64
+	// DefaultCacheTTL is the TTL in seconds used when neither the origin nor
+	// the site configuration says how long a response may be cached.
+	DefaultCacheTTL int64
+	// NegativeCacheTTL is the default TTL in seconds of 404 and 410 responses,
+	// ErrorCacheTTL of 5xx responses. Zero disables caching them.
+	NegativeCacheTTL int64
+	ErrorCacheTTL    int64
+	// CacheRevalidateWindow is how many seconds an expired entry with an ETag or
+	// Last-Modified validator is kept around for conditional revalidation.
+	CacheRevalidateWindow int64
+	// Default seconds an expired entry may still be served while it is refreshed
+	// in the background, and while the origin is failing. Origins can override
+	// them with the stale-while-revalidate and stale-if-error directives.
+	StaleWhileRevalidate int64
+	StaleIfError         int64
+	// Default seconds to connect to an origin, and that an origin may stay
+	// silent while its response is read
+	OriginConnectTimeout int64
+	OriginReadTimeout    int64
+	// OriginRetries is how many more times idempotent requests are sent to the
+	// origins of a site when all of them failed, OriginRetryBackoff the base delay
+	// in milliseconds before a retry, doubled with each one and jittered.
+	OriginRetries      int64
+	OriginRetryBackoff int64
+	// CircuitBreakerThreshold is the default number of consecutive failures after
+	// which requests to an origin fail fast for CircuitBreakerCooldown seconds,
+	// until a probe request succeeds. Zero disables the circuit breaker.
+	CircuitBreakerThreshold int64
+	CircuitBreakerCooldown  int64
+	// HealthCheckTimeout is the timeout in seconds of origin health probes
+	HealthCheckTimeout int64
+	// WarmUpConcurrency is the default number of parallel fetches of a warm-up
+	WarmUpConcurrency int64
+	// CacheName identifies this CDN in Cache-Status response headers
+	CacheName string
+	// CacheDebugHeaders adds the cache key and storage tier to responses
+	CacheDebugHeaders bool
 }
 
 func initConfig() Config {
@@ -24,6 +75,29 @@ func initConfig() Config {
 		RedisHost:     getEnv("REDIS_HOST", "redis"),
 		RedisPort:     getEnv("REDIS_PORT", "6379"),
 		RedisPassword: getEnv("REDIS_PASSWORD", ""),
+		CacheStore:    getEnv("CACHE_STORE", "redis"),
+		CacheDir:      getEnv("CACHE_DIR", "./.cache"),
+
+		DefaultCacheTTL:       getEnvAsInt("DEFAULT_CACHE_TTL", 3600),
+		NegativeCacheTTL:      getEnvAsInt("NEGATIVE_CACHE_TTL", 60),
+		ErrorCacheTTL:         getEnvAsInt("ERROR_CACHE_TTL", 0),
+		CacheRevalidateWindow: getEnvAsInt("CACHE_REVALIDATE_WINDOW", 86400),
+		StaleWhileRevalidate:  getEnvAsInt("STALE_WHILE_REVALIDATE", 60),
+		StaleIfError:          getEnvAsInt("STALE_IF_ERROR", 3600),
+		OriginConnectTimeout:  getEnvAsInt("ORIGIN_CONNECT_TIMEOUT", 5),
+		OriginReadTimeout:     getEnvAsInt("ORIGIN_READ_TIMEOUT", 15),
+		OriginRetries:         getEnvAsInt("ORIGIN_RETRIES", 2),
+		OriginRetryBackoff:    getEnvAsInt("ORIGIN_RETRY_BACKOFF", 100),
+		HealthCheckTimeout:    getEnvAsInt("HEALTH_CHECK_TIMEOUT", 5),
+		WarmUpConcurrency:     getEnvAsInt("WARMUP_CONCURRENCY", 8),
+		L1CacheSize:           getEnvAsInt("L1_CACHE_SIZE", 64*1024*1024),
+		MemoryCacheSize:       getEnvAsInt("MEMORY_CACHE_SIZE", 256*1024*1024),
+		CacheMaxDiskSize:      getEnvAsInt("CACHE_MAX_DISK_SIZE", 0),
+		CacheName:             getEnv("CACHE_NAME", "cdn"),
+		CacheDebugHeaders:     getEnv("CACHE_DEBUG_HEADERS", "false") == "true",
+
+		CircuitBreakerThreshold: getEnvAsInt("CIRCUIT_BREAKER_THRESHOLD", 5),
+		CircuitBreakerCooldown:  getEnvAsInt("CIRCUIT_BREAKER_COOLDOWN", 30),
 	}
 }
 
@@ -34,4 +108,15 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+func getEnvAsInt(key string, fallback int64) int64 {
+	if value, ok := os.LookupEnv(key); ok {
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fallback
+		}
+		return i
+	}
+	return fallback
+}
+
 var Envs = initConfig()
@@ -0,0 +1,28 @@
+package health
+
+import "time"
+
+// State is the health of one origin as seen by the active health checks.
+type State struct {
+	Origin  string `json:"origin"`
+	Healthy bool   `json:"healthy"`
+	// Consecutive successful and failed probes, reset by the opposite result
+	Successes int `json:"successes"`
+	Failures  int `json:"failures"`
+	// CheckedAt is the Unix time of the last probe, StatusCode and Error its outcome
+	CheckedAt  int64  `json:"checked_at"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Store keeps the health of origins. Origins that were never checked have no
+// state and count as healthy.
+type Store interface {
+	// Get returns the states of the given origins that have one
+	Get(origins []string) (map[string]*State, error)
+	// Set stores the state of an origin, forgotten after ttl without updates
+	Set(state *State, ttl time.Duration) error
+	// Claim reserves the probe of an origin for the next interval to the calling
+	// process, so each origin is probed once per interval however many nodes run.
+	Claim(origin string, interval time.Duration) (bool, error)
+}
@@ -0,0 +1,56 @@
+package health
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the health of origins in the memory of a single process,
+// for deployments without Redis.
+type MemoryStore struct {
+	mu     sync.Mutex
+	states map[string]*memoryState
+	claims map[string]time.Time
+}
+
+type memoryState struct {
+	state State
+	until time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		states: map[string]*memoryState{},
+		claims: map[string]time.Time{},
+	}
+}
+
+func (s *MemoryStore) Get(origins []string) (map[string]*State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states := map[string]*State{}
+	for _, origin := range origins {
+		if e, ok := s.states[origin]; ok && time.Now().Before(e.until) {
+			state := e.state
+			states[origin] = &state
+		}
+	}
+	return states, nil
+}
+
+func (s *MemoryStore) Set(state *State, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[state.Origin] = &memoryState{state: *state, until: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *MemoryStore) Claim(origin string, interval time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if until, ok := s.claims[origin]; ok && time.Now().Before(until) {
+		return false, nil
+	}
+	s.claims[origin] = time.Now().Add(interval)
+	return true, nil
+}
@@ -0,0 +1,60 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisStore shares the health of origins between all CDN nodes. The state of
+// an origin is stored as JSON under "health:"+origin.
+type RedisStore struct {
+	rdb *redis.Client
+}
+
+func NewRedisStore(rdb *redis.Client) *RedisStore {
+	return &RedisStore{rdb: rdb}
+}
+
+func (s *RedisStore) Get(origins []string) (map[string]*State, error) {
+	states := map[string]*State{}
+	if len(origins) == 0 {
+		return states, nil
+	}
+	keys := make([]string, len(origins))
+	for i, origin := range origins {
+		keys[i] = "health:" + origin
+	}
+	values, err := s.rdb.MGet(context.Background(), keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		raw, ok := value.(string)
+		if !ok {
+			continue
+		}
+		state := &State{}
+		if err := json.Unmarshal([]byte(raw), state); err != nil {
+			log.Printf("Error decoding health of %s: %v", origins[i], err)
+			continue
+		}
+		states[origins[i]] = state
+	}
+	return states, nil
+}
+
+func (s *RedisStore) Set(state *State, ttl time.Duration) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Set(context.Background(), "health:"+state.Origin, value, ttl).Err()
+}
+
+func (s *RedisStore) Claim(origin string, interval time.Duration) (bool, error) {
+	return s.rdb.SetNX(context.Background(), "health_lock:"+origin, 1, interval).Result()
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/zhitoo/cdn/api"
+	"github.com/zhitoo/cdn/cache"
 	"github.com/zhitoo/cdn/config"
+	"github.com/zhitoo/cdn/health"
 	"github.com/zhitoo/cdn/requests"
 	"github.com/zhitoo/cdn/storage"
 )
@@ -16,17 +25,91 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     config.Envs.RedisHost + ":" + config.Envs.RedisPort,
-		Password: config.Envs.RedisPassword,
-	})
-	// Ping Redis to check if the connection is working
-	_, err = rdb.Ping(context.Background()).Result()
+	store, rdb, err := newCacheStore()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	server := api.NewAPIServer(":"+config.Envs.Port, storage, requests.NewValidator(), rdb)
+	// Origin health is shared through Redis when the cache is
+	var healthStore health.Store = health.NewMemoryStore()
+	if rdb != nil {
+		healthStore = health.NewRedisStore(rdb)
+		// Re-registered sites are reloaded by every process at once
+		api.WatchOriginServers(rdb)
+	}
+
+	server := api.NewAPIServer(":"+config.Envs.Port, storage, requests.NewValidator(), store, healthStore)
+
+	if len(os.Args) > 1 && os.Args[1] == "warmup" {
+		warmUp(server, os.Args[2:])
+		return
+	}
+
 	server.StartCacheCleaner()
+	server.StartHealthChecker()
 	server.Run()
 }
+
+// newCacheStore creates the cache store selected by CACHE_STORE, and returns
+// the Redis client when it uses Redis.
+func newCacheStore() (cache.CacheStore, *redis.Client, error) {
+	switch config.Envs.CacheStore {
+	case "redis":
+		rdb := redis.NewClient(&redis.Options{
+			Addr:     config.Envs.RedisHost + ":" + config.Envs.RedisPort,
+			Password: config.Envs.RedisPassword,
+		})
+		// Ping Redis to check if the connection is working
+		if _, err := rdb.Ping(context.Background()).Result(); err != nil {
+			return nil, nil, err
+		}
+		var store cache.CacheStore = cache.NewRedisStore(rdb)
+		if config.Envs.L1CacheSize > 0 {
+			// Keep hot objects in process, purges reach every process through Redis
+			store = cache.NewL1Store(store, rdb, config.Envs.L1CacheSize)
+		}
+		return store, rdb, nil
+	case "memory":
+		return cache.NewMemoryStore(config.Envs.MemoryCacheSize), nil, nil
+	case "disk":
+		store, err := cache.NewDiskStore()
+		return store, nil, err
+	default:
+		return nil, nil, fmt.Errorf("unknown cache store %q", config.Envs.CacheStore)
+	}
+}
+
+// warmUp implements "cdn warmup [-c concurrency] [file]". It reads one URL per
+// line from file (or stdin) and prints the per-URL results as JSON.
+func warmUp(server *api.APIServer, args []string) {
+	flags := flag.NewFlagSet("warmup", flag.ExitOnError)
+	concurrency := flags.Int("c", int(config.Envs.WarmUpConcurrency), "number of parallel fetches")
+	flags.Parse(args)
+
+	var input io.Reader = os.Stdin
+	if flags.NArg() > 0 && flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	var urls []string
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(server.WarmUp(urls, *concurrency))
+}
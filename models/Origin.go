@@ -0,0 +1,27 @@
+package models
+
+// Origin is one server in the origin pool of an OriginServer. URL has the form
+// of OriginServer.OriginURL, whose scheme, port, base path and Host overrides
+// apply to every origin of the pool.
+type Origin struct {
+	ID             uint `gorm:"primaryKey"`
+	OriginServerID uint `gorm:"index"`
+	URL            string
+	// Weight is the share of requests the origin gets among the origins of the
+	// same Priority. Origins with a higher Priority value are only used when
+	// all the ones with a lower value fail.
+	Weight   int
+	Priority int
+
+	// Active health check: HealthCheckPath (below the site's base path) is
+	// requested every HealthCheckInterval seconds and expected to answer with
+	// HealthCheckStatus. The origin is marked down after UnhealthyThreshold
+	// failed probes in a row and up again after HealthyThreshold successful
+	// ones. An empty HealthCheckPath disables the checks, zero values use the
+	// defaults (10s, 200, 2 and 3).
+	HealthCheckPath     string
+	HealthCheckInterval int64
+	HealthCheckStatus   int
+	HealthyThreshold    int
+	UnhealthyThreshold  int
+}
@@ -3,5 +3,66 @@ package models
 type OriginServer struct {
 	ID             uint   `gorm:"primaryKey"`
 	SiteIdentifier string `gorm:"uniqueIndex"`
-	OriginURL      string
+	// OriginURL is the origin host, optionally with a scheme, port and path
+	OriginURL string
+	// Origins is a pool of replicated origins used instead of OriginURL, and
+	// LoadBalancing how requests are spread over it: round_robin (default),
+	// least_connections or consistent_hash on the cache key.
+	Origins       []Origin `gorm:"constraint:OnDelete:CASCADE"`
+	LoadBalancing string
+	// OriginScheme (http or https) and OriginPort override the ones of
+	// OriginURL, https and the scheme's default port when neither is given.
+	OriginScheme string
+	OriginPort   int
+	// OriginBasePath is prepended to resource paths, so /site/a.png is fetched
+	// from OriginBasePath + /a.png
+	OriginBasePath string
+	// OriginHost replaces the Host header sent to the origin
+	OriginHost string
+	// OriginConnectTimeout and OriginReadTimeout are the seconds allowed to
+	// connect to an origin and between reads of its response. Zero means use the
+	// global default.
+	OriginConnectTimeout int64
+	OriginReadTimeout    int64
+	// OriginRetries is how many times failed GET and HEAD requests are retried
+	// after every origin of the site was tried. Zero means use the global
+	// default, a negative value disables retries.
+	OriginRetries int64
+	// CircuitBreakerThreshold consecutive failures open the circuit of an origin
+	// for CircuitBreakerCooldown seconds. Zero means use the global default, a
+	// negative threshold disables the circuit breaker.
+	CircuitBreakerThreshold int64
+	CircuitBreakerCooldown  int64
+	// DefaultCacheTTL is the fallback TTL in seconds for responses whose
+	// origin sends no caching headers. Zero means use the global default.
+	DefaultCacheTTL int64
+	// SliceSize enables caching objects in slices of this many bytes, fetched
+	// from the origin with Range requests. Zero disables slicing.
+	SliceSize int64
+	// NegativeCacheTTL is how many seconds 404 and 410 responses are cached,
+	// ErrorCacheTTL the same for 5xx responses. Zero means use the global
+	// default, a negative value disables caching them.
+	NegativeCacheTTL int64
+	ErrorCacheTTL    int64
+
+	// Cache key policy. CacheKeyQueryParams lists the query parameters that are
+	// part of the cache key ("*" for all of them), CacheKeyExcludeParams the
+	// ones left out even then; both are comma separated and "utm_*" matches a
+	// prefix. width and height are always part of the key.
+	CacheKeyQueryParams   string
+	CacheKeyExcludeParams string
+	// CacheKeySortParams orders the query parameters, so their order in the
+	// request does not matter
+	CacheKeySortParams bool
+	// Comma separated request headers and cookies whose values are part of the key
+	CacheKeyHeaders string
+	CacheKeyCookies string
+	// CacheKeyIgnoreCase treats paths differing only in case as the same resource
+	CacheKeyIgnoreCase bool
+
+	// Comma separated query parameters ("*" for all, "x_*" for a prefix) and
+	// request headers passed on to the origin. They are always part of the
+	// cache key, since the origin may answer differently for them.
+	ForwardQueryParams string
+	ForwardHeaders     string
 }
@@ -16,6 +16,80 @@ type Login struct {
 
 type RegisterOriginServerRequest struct {
 	SiteIdentifier string `json:"SiteIdentifier" validate:"required"`
-	OriginURL      string `json:"OriginURL" validate:"required"`
+	OriginURL      string `json:"OriginURL" validate:"required_without=Origins,omitempty,origin_url"`
 	APIKey         string `json:"APIKey" validate:"required"`
+
+	// Pool of replicated origins used instead of OriginURL
+	Origins       []OriginRequest `json:"Origins" validate:"omitempty,dive"`
+	LoadBalancing string          `json:"LoadBalancing" validate:"omitempty,oneof=round_robin least_connections consistent_hash"`
+
+	OriginScheme   string `json:"OriginScheme" validate:"omitempty,oneof=http https"`
+	OriginPort     int    `json:"OriginPort" validate:"omitempty,min=1,max=65535"`
+	OriginBasePath string `json:"OriginBasePath" validate:"omitempty,startswith=/"`
+	OriginHost     string `json:"OriginHost" validate:"omitempty,hostname|hostname_port"`
+
+	// Origin timeouts in seconds, retries and circuit breaker, -1 disables the
+	// retries and the circuit breaker
+	OriginConnectTimeout    int64 `json:"OriginConnectTimeout" validate:"omitempty,min=0"`
+	OriginReadTimeout       int64 `json:"OriginReadTimeout" validate:"omitempty,min=0"`
+	OriginRetries           int64 `json:"OriginRetries" validate:"omitempty,min=-1,max=10"`
+	CircuitBreakerThreshold int64 `json:"CircuitBreakerThreshold" validate:"omitempty,min=-1"`
+	CircuitBreakerCooldown  int64 `json:"CircuitBreakerCooldown" validate:"omitempty,min=0"`
+
+	DefaultCacheTTL int64 `json:"DefaultCacheTTL" validate:"omitempty,min=0"`
+	SliceSize       int64 `json:"SliceSize" validate:"omitempty,min=1048576"`
+
+	// Seconds to cache 404/410 and 5xx responses, -1 disables it
+	NegativeCacheTTL int64 `json:"NegativeCacheTTL" validate:"omitempty,min=-1"`
+	ErrorCacheTTL    int64 `json:"ErrorCacheTTL" validate:"omitempty,min=-1"`
+
+	// Cache key policy, see models.OriginServer
+	CacheKeyQueryParams   string `json:"CacheKeyQueryParams" validate:"omitempty"`
+	CacheKeyExcludeParams string `json:"CacheKeyExcludeParams" validate:"omitempty"`
+	CacheKeySortParams    bool   `json:"CacheKeySortParams"`
+	CacheKeyHeaders       string `json:"CacheKeyHeaders" validate:"omitempty"`
+	CacheKeyCookies       string `json:"CacheKeyCookies" validate:"omitempty"`
+	CacheKeyIgnoreCase    bool   `json:"CacheKeyIgnoreCase"`
+
+	// Query parameters and request headers forwarded to the origin
+	ForwardQueryParams string `json:"ForwardQueryParams" validate:"omitempty"`
+	ForwardHeaders     string `json:"ForwardHeaders" validate:"omitempty"`
+}
+
+type OriginRequest struct {
+	URL      string `json:"URL" validate:"required,origin_url"`
+	Weight   int    `json:"Weight" validate:"omitempty,min=1"`
+	Priority int    `json:"Priority" validate:"omitempty,min=0"`
+
+	// Active health check, see models.Origin
+	HealthCheckPath     string `json:"HealthCheckPath" validate:"omitempty,startswith=/"`
+	HealthCheckInterval int64  `json:"HealthCheckInterval" validate:"omitempty,min=1"`
+	HealthCheckStatus   int    `json:"HealthCheckStatus" validate:"omitempty,min=100,max=599"`
+	HealthyThreshold    int    `json:"HealthyThreshold" validate:"omitempty,min=1"`
+	UnhealthyThreshold  int    `json:"UnhealthyThreshold" validate:"omitempty,min=1"`
+}
+
+type PurgeRequest struct {
+	SiteIdentifier string `json:"SiteIdentifier" validate:"required"`
+	// Path purges a single resource, Prefix everything under it, neither the whole site
+	Path   string `json:"Path" validate:"omitempty,startswith=/,excluded_with=Prefix"`
+	Prefix string `json:"Prefix" validate:"omitempty"`
+	// Soft marks entries stale instead of deleting them
+	Soft   bool   `json:"Soft"`
+	APIKey string `json:"APIKey" validate:"required"`
+}
+
+type PurgeTagsRequest struct {
+	SiteIdentifier string `json:"SiteIdentifier" validate:"required"`
+	// Tags is a comma or space separated list of Surrogate-Key/Cache-Tag values
+	Tags   string `json:"Tags" validate:"required"`
+	Soft   bool   `json:"Soft"`
+	APIKey string `json:"APIKey" validate:"required"`
+}
+
+type WarmUpRequest struct {
+	// URLs in the form siteIdentifier/path?width=&height=
+	URLs        []string `json:"URLs" validate:"required,min=1"`
+	Concurrency int      `json:"Concurrency" validate:"omitempty,min=1,max=64"`
+	APIKey      string   `json:"APIKey" validate:"required"`
 }
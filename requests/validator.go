@@ -1,6 +1,9 @@
 package requests
 
 import (
+	"net/url"
+	"strings"
+
 	"github.com/go-playground/validator/v10"
 )
 
@@ -29,6 +32,16 @@ func NewValidator() *Validator {
 	// 	return len(fl.Field().String()) == 11
 	// })
 	//you can add more custom validator here!!
+
+	// origin_url accepts a host with an optional http(s) scheme, port and path
+	NewValidator.validator.RegisterValidation("origin_url", func(fl validator.FieldLevel) bool {
+		raw := fl.Field().String()
+		if !strings.Contains(raw, "://") {
+			raw = "https://" + raw
+		}
+		u, err := url.Parse(raw)
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Hostname() != "" && u.RawQuery == "" && u.Fragment == ""
+	})
 	return NewValidator
 }
 
@@ -12,7 +12,9 @@ type Storage interface {
 	CreateUser(user *models.User) (*models.User, error)
 	GetUserByUserName(userName string) (*models.User, error)
 	GetOriginServerBySiteIdentifier(siteIdentifier string) (*models.OriginServer, error)
+	GetOriginServers() ([]*models.OriginServer, error)
 	CreateOriginServer(os *models.OriginServer) (*models.OriginServer, error)
+	UpdateOriginServer(os *models.OriginServer) (*models.OriginServer, error)
 }
 
 func HashPassword(password string) (string, error) {
@@ -37,6 +39,7 @@ func NewSQLiteStore() (*SQLiteStorage, error) {
 	// Migrate the user schema
 	db.AutoMigrate(&models.User{})
 	db.AutoMigrate(&models.OriginServer{})
+	db.AutoMigrate(&models.Origin{})
 
 	return &SQLiteStorage{db: db}, nil
 }
@@ -60,11 +63,31 @@ func (p *SQLiteStorage) CreateUser(user *models.User) (*models.User, error) {
 
 func (p *SQLiteStorage) GetOriginServerBySiteIdentifier(siteIdentifier string) (*models.OriginServer, error) {
 	os := &models.OriginServer{}
-	result := p.db.Take(os, "site_identifier = ?", siteIdentifier)
+	result := p.db.Preload("Origins").Take(os, "site_identifier = ?", siteIdentifier)
 	return os, result.Error
 }
 
+func (p *SQLiteStorage) GetOriginServers() ([]*models.OriginServer, error) {
+	var origins []*models.OriginServer
+	result := p.db.Preload("Origins").Find(&origins)
+	return origins, result.Error
+}
+
 func (p *SQLiteStorage) CreateOriginServer(os *models.OriginServer) (*models.OriginServer, error) {
 	result := p.db.Create(os)
 	return os, result.Error
 }
+
+func (p *SQLiteStorage) UpdateOriginServer(os *models.OriginServer) (*models.OriginServer, error) {
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		// The pool is replaced as a whole
+		if err := tx.Where("origin_server_id = ?", os.ID).Delete(&models.Origin{}).Error; err != nil {
+			return err
+		}
+		for i := range os.Origins {
+			os.Origins[i].ID = 0
+		}
+		return tx.Save(os).Error
+	})
+	return os, err
+}